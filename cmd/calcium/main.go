@@ -2,14 +2,20 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
+	"text/tabwriter"
+	"time"
 
-	"github.com/klauspost/cpuid/v2"
 	"github.com/minio/selfupdate"
 	"github.com/unkaktus/calcium"
 	"github.com/urfave/cli/v2"
@@ -29,6 +35,25 @@ func run() error {
 				Email: "git@unkaktus.art",
 			},
 		},
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:    "timeout",
+				Usage:   "Timeout of each web request of the TDP lookup",
+				Value:   calcium.DefaultHTTPTimeout,
+				EnvVars: []string{"CALCIUM_TIMEOUT"},
+			},
+			&cli.IntFlag{
+				Name:    "retries",
+				Usage:   "Number of retries of the failed web requests of the TDP lookup",
+				Value:   calcium.DefaultHTTPRetries,
+				EnvVars: []string{"CALCIUM_RETRIES"},
+			},
+		},
+		Before: func(cCtx *cli.Context) error {
+			calcium.DefaultHTTPClient.Timeout = cCtx.Duration("timeout")
+			calcium.DefaultHTTPClient.Retries = cCtx.Int("retries")
+			return nil
+		},
 		Commands: []*cli.Command{
 			{
 				Name:  "run",
@@ -38,6 +63,17 @@ func run() error {
 						Name:  "tag",
 						Usage: "Log consumption under this tag",
 					},
+					&cli.StringFlag{
+						Name:  "powercaproot",
+						Usage: "Root of the powercap sysfs tree to measure RAPL energy from, empty disables the measurement",
+						Value: calcium.DefaultPowercapRoot,
+					},
+					&cli.StringFlag{
+						Name:    "logformat",
+						Usage:   "Format of the log: csv or jsonl",
+						Value:   string(calcium.LogFormatCSV),
+						EnvVars: []string{"CALCIUM_LOGFORMAT"},
+					},
 				},
 				Action: func(cCtx *cli.Context) error {
 					cmdline := append([]string{cCtx.Args().First()}, cCtx.Args().Tail()...)
@@ -49,30 +85,121 @@ func run() error {
 						tag = binaryName
 					}
 
+					powercapRoot := cCtx.String("powercaproot")
+					logFormat, err := calcium.ParseLogFormat(cCtx.String("logformat"))
+					if err != nil {
+						return err
+					}
+
+					result, err := calcium.RunTransparentCommand(cmdline, powercapRoot)
+
 					// Always write usage log
-					defer func() {
-						if err := calcium.WriteLog(tag); err != nil {
-							log.Printf("write log: %v", err)
-						}
-					}()
+					if err := calcium.WriteLog(tag, result, logFormat); err != nil {
+						log.Printf("write log: %v", err)
+					}
 
-					if err := calcium.RunTransparentCommand(cmdline); err != nil {
+					// Exit with the shell statuses if the command cannot be started
+					switch {
+					case errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist):
+						return cli.Exit(fmt.Sprintf("run command: %v", err), 127)
+					case errors.Is(err, fs.ErrPermission):
+						return cli.Exit(fmt.Sprintf("run command: %v", err), 126)
+					case err != nil:
 						return fmt.Errorf("run command: %w", err)
 					}
 
+					// Exit with the same status as the command
+					if result.ExitCode != 0 {
+						return cli.Exit("", result.ExitCode)
+					}
+
 					return nil
 				},
 			},
 			{
 				Name:  "tdp",
 				Usage: "Get the TDP of a CPU by its CPUID string",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "offline",
+						Usage:   "Do not access the network",
+						EnvVars: []string{"CALCIUM_OFFLINE"},
+					},
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:      "set",
+						Usage:     "Override the TDP per core of a CPU",
+						ArgsUsage: "<cpu> <watts-per-core>",
+						Flags:     overrideFlags,
+						Action: func(cCtx *cli.Context) error {
+							if cCtx.Args().Len() != 2 {
+								return fmt.Errorf("expected CPU string and TDP per core")
+							}
+							override, err := parseOverride(cCtx)
+							if err != nil {
+								return err
+							}
+							override.Watts, err = strconv.ParseFloat(cCtx.Args().Get(1), 64)
+							if err != nil {
+								return fmt.Errorf("parse TDP: %w", err)
+							}
+
+							overrides, err := calcium.ReadTDPOverrides()
+							if err != nil {
+								return fmt.Errorf("read overrides: %w", err)
+							}
+							overrides.Set(override)
+							if err := calcium.WriteTDPOverrides(overrides); err != nil {
+								return fmt.Errorf("write overrides: %w", err)
+							}
+							return nil
+						},
+					},
+					{
+						Name:      "unset",
+						Usage:     "Remove the TDP override of a CPU",
+						ArgsUsage: "<cpu>",
+						Flags:     overrideFlags,
+						Action: func(cCtx *cli.Context) error {
+							if cCtx.Args().Len() != 1 {
+								return fmt.Errorf("expected CPU string")
+							}
+							override, err := parseOverride(cCtx)
+							if err != nil {
+								return err
+							}
+
+							overrides, err := calcium.ReadTDPOverrides()
+							if err != nil {
+								return fmt.Errorf("read overrides: %w", err)
+							}
+							if !overrides.Unset(override) {
+								return fmt.Errorf("override not found")
+							}
+							if err := calcium.WriteTDPOverrides(overrides); err != nil {
+								return fmt.Errorf("write overrides: %w", err)
+							}
+							return nil
+						},
+					},
+					{
+						Name:        "cache",
+						Usage:       "Manage the cache of the TDP values looked up on the web",
+						Subcommands: tdpCacheCommands,
+					},
+				},
 				Action: func(cCtx *cli.Context) error {
 					cpuString := cCtx.Args().Get(0)
 					if cpuString == "" {
-						cpuString = cpuid.CPU.BrandName
+						cpuString = calcium.CPUString()
 					}
 
-					tdpInfo, err := calcium.GetTDPInfoCached(cpuString)
+					getTDPInfo := calcium.GetTDPInfoCached
+					if cCtx.Bool("offline") {
+						getTDPInfo = calcium.GetTDPInfoOffline
+					}
+					tdpInfo, err := getTDPInfo(cpuString)
 					if err != nil {
 						return fmt.Errorf("get TDP info: %w", err)
 					}
@@ -93,22 +220,180 @@ func run() error {
 					},
 					&cli.StringFlag{
 						Name:  "logfile",
-						Usage: "Filename of the log file",
+						Usage: "Filename of the log file, all the logs in the calcium directory by default",
 					},
 					&cli.Float64Flag{
 						Name:  "nodefactor",
 						Usage: "Multiplication factor for the TDP to account for consumption of other node components",
-						Value: 1.17,
+						Value: calcium.DefaultNodeFactor,
+					},
+					&cli.Float64Flag{
+						Name:  "memorypower",
+						Usage: "Power consumption of resident memory in W/GB, zero disables the memory power model",
+					},
+					&cli.Float64Flag{
+						Name:  "smtfactor",
+						Usage: "Scaling factor for the TDP per core on hosts with SMT, -1 for per-thread TDP, 1 to disable",
+						Value: calcium.SMTFactorPerThread,
+					},
+					&cli.StringSliceFlag{
+						Name:  "tag",
+						Usage: "Only report on this tag, can be repeated",
+					},
+					&cli.BoolFlag{
+						Name:    "offline",
+						Usage:   "Do not access the network, use the default TDP for unknown CPUs",
+						EnvVars: []string{"CALCIUM_OFFLINE"},
+					},
+					&cli.Float64Flag{
+						Name:  "defaultwatts",
+						Usage: "TDP per core in W for CPUs with unknown TDP in offline mode",
+						Value: calcium.DefaultTDPWatts,
+					},
+					&cli.StringFlag{
+						Name:  "since",
+						Usage: "Only report on runs that ended at or after this date or time",
+					},
+					&cli.StringFlag{
+						Name:  "until",
+						Usage: "Only report on runs that ended before this date or time",
+					},
+					&cli.StringFlag{
+						Name:    "intensityfile",
+						Aliases: []string{"intensity-file"},
+						Usage:   "Carbon intensity dataset in the OWID grapher or region,year,value CSV format",
 					},
 				},
 				Action: func(cCtx *cli.Context) error {
 					logFilename := cCtx.String("logfile")
-					region := cCtx.String("region")
-					nodeFactor := cCtx.Float64("nodefactor")
-					err := calcium.MakeReport(logFilename, region, nodeFactor)
+					options := calcium.ReportOptions{
+						NodeFactor:   cCtx.Float64("nodefactor"),
+						MemoryPower:  cCtx.Float64("memorypower"),
+						SMTFactor:    cCtx.Float64("smtfactor"),
+						Tags:         cCtx.StringSlice("tag"),
+						Offline:      cCtx.Bool("offline"),
+						DefaultWatts: cCtx.Float64("defaultwatts"),
+					}
+					if region := cCtx.String("region"); region != "none" {
+						options.Region = region
+					}
+					var err error
+					if options.Since, err = parseTime(cCtx.String("since")); err != nil {
+						return fmt.Errorf("parse since: %w", err)
+					}
+					if options.Until, err = parseTime(cCtx.String("until")); err != nil {
+						return fmt.Errorf("parse until: %w", err)
+					}
+					if intensityFilename := cCtx.String("intensityfile"); intensityFilename != "" {
+						options.CarbonIntensityData, err = calcium.ReadCarbonIntensityFile(intensityFilename)
+						if err != nil {
+							return fmt.Errorf("read carbon intensity file: %w", err)
+						}
+					}
+					_, err = calcium.MakeReport(os.Stdout, logFilename, options)
 					return err
 				},
 			},
+			{
+				Name:  "log",
+				Usage: "Manage the log",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "repair",
+						Usage: "Report malformed lines in the log and rewrite the salvageable ones",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "logfile",
+								Usage: "Filename of the log file, all the logs in the calcium directory by default",
+							},
+						},
+						Action: func(cCtx *cli.Context) error {
+							logFilenames := []string{cCtx.String("logfile")}
+							if logFilenames[0] == "" {
+								filenames, err := calcium.DefaultLogFilenames()
+								if err != nil {
+									return fmt.Errorf("get log filenames: %w", err)
+								}
+								logFilenames = filenames
+							}
+							for _, logFilename := range logFilenames {
+								lineErrors, err := calcium.RepairLogFile(logFilename)
+								if err != nil {
+									return fmt.Errorf("repair log %s: %w", logFilename, err)
+								}
+								for _, lineError := range lineErrors {
+									action := "dropped"
+									if lineError.Salvaged {
+										action = "salvaged"
+									}
+									fmt.Printf("%s:%d: %s: %v\n", logFilename, lineError.Line, action, lineError.Err)
+								}
+								if len(lineErrors) == 0 {
+									fmt.Printf("%s: no malformed lines\n", logFilename)
+								} else {
+									fmt.Printf("%s: repaired, the original is kept in %s.bak\n", logFilename, logFilename)
+								}
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:      "regions",
+				Usage:     "List the regions with carbon intensity data, optionally searching by code or name",
+				ArgsUsage: "[search]",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "year",
+						Usage: "Show the carbon intensity of this year (or the nearest available one), the latest year by default",
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Output format: table or json",
+						Value: "table",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					regions, err := calcium.ListRegions(cCtx.Args().First(), cCtx.Int("year"))
+					if err != nil {
+						return fmt.Errorf("list regions: %w", err)
+					}
+					switch cCtx.String("format") {
+					case "table":
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						fmt.Fprintf(w, "CODE\tNAME\tYEAR\tgCO2e/kWh\n")
+						for _, region := range regions {
+							fmt.Fprintf(w, "%s\t%s\t%d\t%.2f\n", region.Code, region.Name, region.Year, region.CarbonIntensity)
+						}
+						return w.Flush()
+					case "json":
+						jsonData, _ := json.MarshalIndent(regions, "", "     ")
+						fmt.Printf("%s\n", jsonData)
+						return nil
+					default:
+						return fmt.Errorf("unknown format %q", cCtx.String("format"))
+					}
+				},
+			},
+			{
+				Name:  "data",
+				Usage: "Manage the carbon intensity data",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "update",
+						Usage: "Download the latest carbon intensity data from Our World in Data to use instead of the embedded one",
+						Action: func(cCtx *cli.Context) error {
+							dataset, err := calcium.UpdateCarbonIntensityData(cCtx.Context, nil)
+							if err != nil {
+								return fmt.Errorf("update carbon intensity data: %w", err)
+							}
+							fmt.Printf("Updated carbon intensity data of %d regions.\n", len(dataset.Series))
+							return nil
+						},
+					},
+				},
+			},
 			{
 				Name:  "update",
 				Usage: "Update itself",
@@ -136,6 +421,174 @@ func run() error {
 	return app.Run(os.Args)
 }
 
+var tdpCacheCommands = []*cli.Command{
+	{
+		Name:  "list",
+		Usage: "List the cached TDP values",
+		Action: func(cCtx *cli.Context) error {
+			cache, err := calcium.ReadTDPCache()
+			if err != nil {
+				return fmt.Errorf("read cache: %w", err)
+			}
+			for _, err := range cache.Malformed {
+				log.Printf("skipped malformed entry: %v", err)
+			}
+			jsonData, _ := json.MarshalIndent(cache.Entries, "", "     ")
+			fmt.Printf("%s\n", jsonData)
+			return nil
+		},
+	},
+	{
+		Name:      "remove",
+		Usage:     "Remove the cached TDP values of the CPUs",
+		ArgsUsage: "<cpu>...",
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.Args().Len() == 0 {
+				return fmt.Errorf("expected CPU strings")
+			}
+			return calcium.UpdateTDPCache(func(cache *calcium.TDPCache) error {
+				for _, cpuString := range cCtx.Args().Slice() {
+					if !cache.Remove(cpuString) {
+						return fmt.Errorf("%s: not in cache", cpuString)
+					}
+				}
+				return nil
+			})
+		},
+	},
+	{
+		Name:      "refresh",
+		Usage:     "Look up the cached TDP values again, all of them if no CPUs are given",
+		ArgsUsage: "[<cpu>...]",
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:  "olderthan",
+				Usage: "Only refresh the values fetched earlier than this duration ago",
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			refreshErrors, err := calcium.RefreshTDPCache(cCtx.Args().Slice(), cCtx.Duration("olderthan"))
+			if err != nil {
+				return err
+			}
+			for _, err := range refreshErrors {
+				log.Printf("refresh: %v", err)
+			}
+			if len(refreshErrors) > 0 {
+				return fmt.Errorf("failed to refresh %d entries", len(refreshErrors))
+			}
+			return nil
+		},
+	},
+	{
+		Name:      "export",
+		Usage:     "Export the cache to a file, or to stdout if no file is given",
+		ArgsUsage: "[<file>]",
+		Action: func(cCtx *cli.Context) error {
+			cache, err := calcium.ReadTDPCache()
+			if err != nil {
+				return fmt.Errorf("read cache: %w", err)
+			}
+			w := os.Stdout
+			if filename := cCtx.Args().First(); filename != "" {
+				w, err = os.Create(filename)
+				if err != nil {
+					return fmt.Errorf("create export file: %w", err)
+				}
+				defer w.Close()
+			}
+			if err := calcium.WriteTDPCacheTo(w, cache); err != nil {
+				return fmt.Errorf("export cache: %w", err)
+			}
+			return w.Close()
+		},
+	},
+	{
+		Name:      "import",
+		Usage:     "Import the cache file, replacing the existing values of the same CPUs",
+		ArgsUsage: "<file>",
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.Args().Len() != 1 {
+				return fmt.Errorf("expected cache file")
+			}
+			importFile, err := os.Open(cCtx.Args().First())
+			if err != nil {
+				return fmt.Errorf("open import file: %w", err)
+			}
+			defer importFile.Close()
+			imported, err := calcium.ReadTDPCacheFrom(importFile)
+			if err != nil {
+				return fmt.Errorf("read import file: %w", err)
+			}
+			if len(imported.Malformed) > 0 {
+				return fmt.Errorf("malformed import file: %w", errors.Join(imported.Malformed...))
+			}
+
+			if err := calcium.UpdateTDPCache(func(cache *calcium.TDPCache) error {
+				for _, tdpInfo := range imported.Entries {
+					cache.Set(tdpInfo)
+				}
+				return nil
+			}); err != nil {
+				return fmt.Errorf("update cache: %w", err)
+			}
+			fmt.Printf("Imported %d entries.\n", len(imported.Entries))
+			return nil
+		},
+	},
+}
+
+var overrideFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "host",
+		Usage: "Only apply on hosts matching this glob pattern",
+	},
+	&cli.BoolFlag{
+		Name:  "glob",
+		Usage: "Treat the CPU string as a glob pattern",
+	},
+	&cli.BoolFlag{
+		Name:  "regex",
+		Usage: "Treat the CPU string as a regular expression",
+	},
+}
+
+// parseOverride makes the override key from the CPU string argument and flags
+func parseOverride(cCtx *cli.Context) (calcium.TDPOverride, error) {
+	cpuString := cCtx.Args().First()
+	override := calcium.TDPOverride{
+		Host: cCtx.String("host"),
+	}
+	switch {
+	case cCtx.Bool("glob") && cCtx.Bool("regex"):
+		return override, fmt.Errorf("glob and regex are mutually exclusive")
+	case cCtx.Bool("glob"):
+		override.Glob = cpuString
+	case cCtx.Bool("regex"):
+		if _, err := regexp.Compile(cpuString); err != nil {
+			return override, fmt.Errorf("compile regex: %w", err)
+		}
+		override.Regex = cpuString
+	default:
+		override.CPU = cpuString
+	}
+	return override, nil
+}
+
+// parseTime parses a local date or date and time, empty string is zero time
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.DateTime, time.DateOnly} {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date or time %q", s)
+}
+
 func main() {
 	if err := run(); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,159 @@
+package calcium
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	cpuid "github.com/klauspost/cpuid/v2"
+)
+
+const (
+	procCPUInfo  = "/proc/cpuinfo"
+	dmiSysVendor = "/sys/devices/virtual/dmi/id/sys_vendor"
+	smtActive    = "/sys/devices/system/cpu/smt/active"
+)
+
+// MIDR holds the implementer and part number fields
+// of the Main ID Register of an ARM core
+type MIDR struct {
+	Implementer uint64
+	Part        uint64
+}
+
+var armImplementers = map[uint64]string{
+	0x41: "ARM",
+	0x46: "Fujitsu",
+	0x48: "HiSilicon",
+	0x4e: "NVIDIA",
+	0x51: "Qualcomm",
+	0xc0: "Ampere",
+}
+
+var armParts = map[MIDR]string{
+	{0x41, 0xd08}: "Cortex-A72",
+	{0x41, 0xd0c}: "Neoverse-N1",
+	{0x41, 0xd40}: "Neoverse-V1",
+	{0x41, 0xd49}: "Neoverse-N2",
+	{0x41, 0xd4f}: "Neoverse-V2",
+	{0x46, 0x001}: "A64FX",
+	{0x48, 0xd01}: "Kunpeng-920",
+	{0xc0, 0xac3}: "AmpereOne",
+	{0xc0, 0xac4}: "AmpereOne AC04",
+}
+
+// AWS Graviton processors are built from stock Neoverse cores,
+// so they are told apart from other parts by the platform.
+var awsGravitons = map[MIDR]string{
+	{0x41, 0xd08}: "AWS Graviton",
+	{0x41, 0xd0c}: "AWS Graviton2",
+	{0x41, 0xd40}: "AWS Graviton3",
+	{0x41, 0xd4f}: "AWS Graviton4",
+}
+
+func parseCPUInfoHex(s string) (uint64, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "0x")
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// ReadMIDR reads the MIDR fields of the first core from /proc/cpuinfo
+func ReadMIDR(cpuinfo io.Reader) (*MIDR, error) {
+	midr := &MIDR{}
+	foundImplementer, foundPart := false, false
+	scanner := bufio.NewScanner(cpuinfo)
+	for scanner.Scan() && !(foundImplementer && foundPart) {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		var err error
+		switch strings.TrimSpace(key) {
+		case "CPU implementer":
+			midr.Implementer, err = parseCPUInfoHex(value)
+			foundImplementer = true
+		case "CPU part":
+			midr.Part, err = parseCPUInfoHex(value)
+			foundPart = true
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", strings.TrimSpace(key), err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read cpuinfo: %w", err)
+	}
+	if !foundImplementer || !foundPart {
+		return nil, fmt.Errorf("MIDR not found")
+	}
+	return midr, nil
+}
+
+// CPUString returns a stable identifier of the ARM CPU, like "ARM Neoverse-N1",
+// or "AWS Graviton2" if running on Amazon EC2. Unknown parts are identified
+// by their implementer and part numbers.
+func (m MIDR) CPUString(sysVendor string) string {
+	if sysVendor == "Amazon EC2" {
+		if name, ok := awsGravitons[m]; ok {
+			return name
+		}
+	}
+	implementer, ok := armImplementers[m.Implementer]
+	if !ok {
+		return fmt.Sprintf("ARM implementer 0x%02x part 0x%03x", m.Implementer, m.Part)
+	}
+	part, ok := armParts[m]
+	if !ok {
+		return fmt.Sprintf("%s part 0x%03x", implementer, m.Part)
+	}
+	return implementer + " " + part
+}
+
+// ARMCPUString derives the identifier of the ARM CPU of this machine
+// from /proc/cpuinfo and the DMI system vendor
+func ARMCPUString() (string, error) {
+	cpuinfo, err := os.Open(procCPUInfo)
+	if err != nil {
+		return "", fmt.Errorf("open cpuinfo: %w", err)
+	}
+	defer cpuinfo.Close()
+
+	midr, err := ReadMIDR(cpuinfo)
+	if err != nil {
+		return "", err
+	}
+	// The system vendor is not available on all machines
+	sysVendor, _ := os.ReadFile(dmiSysVendor)
+	return midr.CPUString(strings.TrimSpace(string(sysVendor))), nil
+}
+
+// CPUString returns the identifier of the CPU of this machine used in the logs.
+// It is the CPUID brand string, or the one derived from MIDR on ARM CPUs
+// that have no brand string.
+func CPUString() string {
+	if cpuid.CPU.BrandName != "" {
+		return cpuid.CPU.BrandName
+	}
+	cpuString, err := ARMCPUString()
+	if err != nil {
+		return ""
+	}
+	return cpuString
+}
+
+// ThreadsPerCore returns the number of hardware threads per core in use on this machine.
+// CPUID reports the topology of the CPU even if SMT is turned off,
+// so on Linux it is 1 if SMT is not active, e.g., on nodes booted with nosmt.
+func ThreadsPerCore() int {
+	return threadsPerCore(smtActive, cpuid.CPU.ThreadsPerCore)
+}
+
+func threadsPerCore(smtActiveFilename string, cpuidThreadsPerCore int) int {
+	// The SMT state is not available on other systems and older kernels
+	if active, err := readUintFile(smtActiveFilename); err == nil && active == 0 {
+		return 1
+	}
+	return cpuidThreadsPerCore
+}
@@ -0,0 +1,31 @@
+package calcium
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestThreadsPerCore(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		smtActive string // Content of the SMT state file, missing if empty
+		want      int
+	}{
+		{"1\n", 2},
+		{"0\n", 1},
+		{"", 2},
+	}
+	for i, test := range tests {
+		filename := filepath.Join(dir, "missing")
+		if test.smtActive != "" {
+			filename = filepath.Join(dir, "active")
+			if err := os.WriteFile(filename, []byte(test.smtActive), 0664); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := threadsPerCore(filename, 2); got != test.want {
+			t.Errorf("test %d: got %d threads per core, want %d", i, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package calcium
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	// Intel brand strings of Core generations since the 11th start with it
+	generationPrefixPattern = regexp.MustCompile(`(?i)^\s*[0-9]+(st|nd|rd|th)\s+Gen\s+`)
+	trademarkPattern        = regexp.MustCompile(`(?i)\((r|tm)\)|®|™`)
+	clockSuffixPattern      = regexp.MustCompile(`(?i)\s*@\s*[0-9.]+\s*[GM]Hz\s*$`)
+	graphicsPattern         = regexp.MustCompile(`(?i)\s+(w/|with)\s+.*Graphics\s*$`)
+	noiseWordPattern        = regexp.MustCompile(`(?i)\b([0-9]+-Core|CPU|Processor)\b`)
+)
+
+// NormalizeCPUString maps the CPUID brand string to the canonical model identifier,
+// e.g., "Intel(R) Xeon(R) Gold 6148 CPU @ 2.40GHz" to "Intel Xeon Gold 6148",
+// "AMD EPYC 7763 64-Core Processor" to "AMD EPYC 7763", and
+// "11th Gen Intel(R) Core(TM) i7-1165G7 @ 2.80GHz" to "Intel Core i7-1165G7".
+// The clock is kept if there is no model number, as in the generic brand strings
+// of cloud machines like "Intel(R) Xeon(R) CPU @ 2.20GHz".
+func NormalizeCPUString(cpuString string) string {
+	s := generationPrefixPattern.ReplaceAllString(cpuString, "")
+	s = trademarkPattern.ReplaceAllString(s, " ")
+	s = graphicsPattern.ReplaceAllString(s, "")
+	s = noiseWordPattern.ReplaceAllString(s, " ")
+	if withoutClock := clockSuffixPattern.ReplaceAllString(s, ""); hasModelNumber(withoutClock) {
+		s = withoutClock
+	}
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// hasModelNumber tells whether any token of the CPU string has a digit
+func hasModelNumber(s string) bool {
+	return strings.IndexFunc(s, unicode.IsDigit) >= 0
+}
+
+// SameCPUModel tells whether the CPU strings are of the same model.
+// Generic CPU strings without a model number, like "Intel(R) Xeon(R) Processor",
+// only match themselves.
+func SameCPUModel(a, b string) bool {
+	if a == b {
+		return true
+	}
+	normalizedA, normalizedB := NormalizeCPUString(a), NormalizeCPUString(b)
+	if !hasModelNumber(normalizedA) || !hasModelNumber(normalizedB) {
+		return false
+	}
+	return strings.EqualFold(normalizedA, normalizedB)
+}
+
+// splitCPUModel splits the lowercase normalized CPU string into
+// the name (vendor, family) and the model number parts
+func splitCPUModel(cpuString string) (name, number string) {
+	names := []string{}
+	numbers := []string{}
+	for _, token := range strings.Fields(strings.ToLower(NormalizeCPUString(cpuString))) {
+		if hasModelNumber(token) {
+			numbers = append(numbers, token)
+		} else {
+			names = append(names, token)
+		}
+	}
+	return strings.Join(names, " "), strings.Join(numbers, " ")
+}
+
+func levenshtein(a, b []rune) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			prev, row[j] = row[j], min(row[j]+1, row[j-1]+1, prev+cost)
+		}
+	}
+	return row[len(b)]
+}
+
+// CPUMatchConfidence estimates how likely the CPU strings are of the same model,
+// from 0 to 1. The model numbers, i.e. all the tokens with digits, must be the same,
+// as "8468V" and "8468", or "Graviton4" and "Graviton3", are different parts.
+// Only the rest of the names are compared by the edit distance.
+func CPUMatchConfidence(a, b string) float64 {
+	nameA, numberA := splitCPUModel(a)
+	nameB, numberB := splitCPUModel(b)
+	if numberA != numberB {
+		return 0
+	}
+
+	maxLength := max(len([]rune(nameA)), len([]rune(nameB)))
+	if maxLength == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein([]rune(nameA), []rune(nameB)))/float64(maxLength)
+}
+
+// FuzzyMatchCPU finds the candidate CPU string closest to the CPU string
+// and the confidence of the match
+func FuzzyMatchCPU(cpuString string, candidates []string) (string, float64) {
+	best := ""
+	bestConfidence := 0.0
+	for _, candidate := range candidates {
+		confidence := CPUMatchConfidence(cpuString, candidate)
+		if confidence > bestConfidence {
+			best = candidate
+			bestConfidence = confidence
+		}
+	}
+	return best, bestConfidence
+}
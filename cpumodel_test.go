@@ -0,0 +1,83 @@
+package calcium
+
+import "testing"
+
+func TestNormalizeCPUString(t *testing.T) {
+	tests := map[string]string{
+		"Intel(R) Xeon(R) Gold 6148 CPU @ 2.40GHz":       "Intel Xeon Gold 6148",
+		"AMD EPYC 7763 64-Core Processor":                "AMD EPYC 7763",
+		"AMD Ryzen 7 7840U w/ Radeon 780M Graphics":      "AMD Ryzen 7 7840U",
+		"11th Gen Intel(R) Core(TM) i7-1165G7 @ 2.80GHz": "Intel Core i7-1165G7",
+		"13th Gen Intel(R) Core(TM) i9-13900K":           "Intel Core i9-13900K",
+		"AWS Graviton3":                                  "AWS Graviton3",
+		// Generic brand strings of cloud machines keep the clock
+		"Intel(R) Xeon(R) CPU @ 2.20GHz": "Intel Xeon @ 2.20GHz",
+		"Intel(R) Xeon(R) CPU @ 2.80GHz": "Intel Xeon @ 2.80GHz",
+		"Intel(R) Xeon(R) Processor":     "Intel Xeon",
+	}
+	for cpuString, want := range tests {
+		if got := NormalizeCPUString(cpuString); got != want {
+			t.Errorf("NormalizeCPUString(%q) = %q, want %q", cpuString, got, want)
+		}
+	}
+}
+
+func TestSameCPUModel(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"Intel(R) Xeon(R) Gold 6148 CPU @ 2.40GHz", "Intel Xeon Gold 6148", true},
+		{"Intel(R) Xeon(R) CPU @ 2.20GHz", "Intel(R) Xeon(R) CPU @ 2.20GHz", true},
+		{"Intel(R) Xeon(R) CPU @ 2.20GHz", "Intel(R) Xeon(R) CPU @ 2.80GHz", false},
+		{"Intel(R) Xeon(R) CPU @ 2.20GHz", "Intel(R) Xeon(R) Processor", false},
+		{"Intel(R) Xeon(R) Processor", "Intel Xeon", false},
+		{"Intel(R) Xeon(R) Processor", "Intel(R) Xeon(R) Processor", true},
+	}
+	for _, test := range tests {
+		if same := SameCPUModel(test.a, test.b); same != test.same {
+			t.Errorf("SameCPUModel(%q, %q) = %v, want %v", test.a, test.b, same, test.same)
+		}
+	}
+}
+
+func TestCPUMatchConfidence(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		match bool
+	}{
+		// Different parts with similar model numbers
+		{"AWS Graviton4", "AWS Graviton3", false},
+		{"ARM Neoverse-N2", "ARM Neoverse-N1", false},
+		{"ARM Neoverse-V1", "ARM Neoverse-V2", false},
+		{"Intel(R) Xeon(R) Platinum 8468V", "Intel(R) Xeon(R) Platinum 8468", false},
+		{"AMD EPYC 9654P 96-Core Processor", "AMD EPYC 9654 96-Core Processor", false},
+		{"Intel(R) Xeon(R) Gold 6130 CPU @ 2.10GHz", "Intel(R) Xeon(R) Gold 6148 CPU @ 2.40GHz", false},
+		{"Ampere AmpereOne AC04", "Ampere AmpereOne", false},
+		// Same parts with different names
+		{"Intel(R) Xeon(R) Gold 6148 CPU @ 2.40GHz", "Intel Xeon Gold 6148", true},
+		{"Intel Zeon Platinum 8468", "Intel(R) Xeon(R) Platinum 8468", true},
+		{"AMD EPYC 7763 64-Core Processor", "AMD Epyc 7763", true},
+	}
+	for _, test := range tests {
+		confidence := CPUMatchConfidence(test.a, test.b)
+		if match := confidence >= DefaultMatchConfidence; match != test.match {
+			t.Errorf("CPUMatchConfidence(%q, %q) = %.3f, want match %v", test.a, test.b, confidence, test.match)
+		}
+	}
+}
+
+func TestFuzzyMatchCPU(t *testing.T) {
+	candidates := []string{
+		"Intel(R) Xeon(R) Platinum 8468",
+		"Intel(R) Xeon(R) Platinum 8470",
+		"AWS Graviton3",
+	}
+	matched, confidence := FuzzyMatchCPU("Intel Zeon Platinum 8468", candidates)
+	if matched != candidates[0] || confidence < DefaultMatchConfidence {
+		t.Errorf("got %q with confidence %.3f, want %q", matched, confidence, candidates[0])
+	}
+	if matched, confidence := FuzzyMatchCPU("AWS Graviton4", candidates); confidence >= DefaultMatchConfidence {
+		t.Errorf("got %q with confidence %.3f, want no match", matched, confidence)
+	}
+}
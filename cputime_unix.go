@@ -10,15 +10,39 @@ type CPUTime struct {
 	System time.Duration
 }
 
-func GetCPUTime() (*CPUTime, error) {
+type ResourceUsage struct {
+	CPUTime
+	MaxRSS                     int64 // [bytes]
+	InBlock                    int64
+	OutBlock                   int64
+	VoluntaryContextSwitches   int64
+	InvoluntaryContextSwitches int64
+}
+
+func GetResourceUsage() (*ResourceUsage, error) {
 	rusage := &syscall.Rusage{}
 	if err := syscall.Getrusage(syscall.RUSAGE_CHILDREN, rusage); err != nil {
 		return nil, err
 	}
-	cpuTime := &CPUTime{
-		System: time.Duration(rusage.Stime.Nano()),
-		User:   time.Duration(rusage.Utime.Nano()),
+	resourceUsage := &ResourceUsage{
+		CPUTime: CPUTime{
+			System: time.Duration(rusage.Stime.Nano()),
+			User:   time.Duration(rusage.Utime.Nano()),
+		},
+		MaxRSS:                     int64(rusage.Maxrss) * maxRSSUnit,
+		InBlock:                    int64(rusage.Inblock),
+		OutBlock:                   int64(rusage.Oublock),
+		VoluntaryContextSwitches:   int64(rusage.Nvcsw),
+		InvoluntaryContextSwitches: int64(rusage.Nivcsw),
 	}
 
-	return cpuTime, nil
+	return resourceUsage, nil
+}
+
+func GetCPUTime() (*CPUTime, error) {
+	resourceUsage, err := GetResourceUsage()
+	if err != nil {
+		return nil, err
+	}
+	return &resourceUsage.CPUTime, nil
 }
@@ -1,8 +1,6 @@
 package data
 
 import (
-	"encoding/csv"
-	"strconv"
 	"strings"
 )
 
@@ -5749,45 +5747,34 @@ Zimbabwe,ZWE,2022,297.53918
 Zimbabwe,ZWE,2023,298.4356
 `
 
-type CarbonIntensity struct {
-	Region string
-	Year   int
-	Value  float64
-}
+// EmbeddedCarbonIntensityData is the carbon intensity dataset compiled into calcium,
+// including the subnational grid regions
+var EmbeddedCarbonIntensityData = &CarbonIntensityDataset{}
+
+// SubregionCarbonIntensityData is the dataset of the subnational grid regions
+var SubregionCarbonIntensityData = &CarbonIntensityDataset{}
 
 var (
+	// Carbon intensity of the latest year of the embedded dataset, keyed by region
 	CarbonIntensities = map[string]CarbonIntensity{}
+	// Carbon intensity of all the available years of the embedded dataset sorted by year, keyed by region
+	CarbonIntensitySeries = map[string][]CarbonIntensity{}
+	// Names of the regions of the embedded dataset, keyed by region
+	RegionNames = map[string]string{}
 )
 
 func readCarbonIntesities() {
-	reader := strings.NewReader(carbonIntensitiesCSVData)
-	csvReader := csv.NewReader(reader)
-	csvReader.Comment = '#'
-
-	records, _ := csvReader.ReadAll()
-	for _, row := range records {
-		region := row[1]
-		year, err := strconv.Atoi(row[2])
-		if err != nil {
-			panic(err)
-		}
-		carbonIntensityValue, err := strconv.ParseFloat(row[3], 64)
-		if err != nil {
-			panic(err)
-		}
-		carbonIntensity := CarbonIntensity{
-			Region: region,
-			Year:   year,
-			Value:  carbonIntensityValue,
-		}
-		if _, ok := CarbonIntensities[region]; !ok {
-			CarbonIntensities[region] = carbonIntensity
-			continue
-		}
-		if year > CarbonIntensities[region].Year {
-			CarbonIntensities[region] = carbonIntensity
-		}
+	dataset, err := ReadCarbonIntensityDataset(strings.NewReader(carbonIntensitiesCSVData))
+	if err != nil {
+		panic(err)
 	}
+	dataset.Source = "Ember (2025); Energy Institute - Statistical Review of World Energy (2025) – with major processing by Our World in Data"
+	SubregionCarbonIntensityData = readSubregionCarbonIntensities()
+	dataset.Merge(SubregionCarbonIntensityData)
+	EmbeddedCarbonIntensityData = dataset
+	CarbonIntensities = dataset.Latest
+	CarbonIntensitySeries = dataset.Series
+	RegionNames = dataset.Names
 }
 
 func init() {
@@ -0,0 +1,206 @@
+package data
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CarbonIntensity struct {
+	Region string
+	Year   int
+	Value  float64
+}
+
+// AggregateRegionIDs are the stable identifiers of the aggregate regions,
+// which have no code in the dataset, keyed by the entity name.
+// The Ember aggregates are suffixed with _EMBER if there is the same aggregate by OWID.
+var AggregateRegionIDs = map[string]string{
+	"ASEAN (Ember)":                       "ASEAN",
+	"Africa":                              "AFRICA",
+	"Africa (Ember)":                      "AFRICA_EMBER",
+	"Asia":                                "ASIA",
+	"Asia (Ember)":                        "ASIA_EMBER",
+	"EU (Ember)":                          "EU_EMBER",
+	"Europe":                              "EUROPE",
+	"Europe (Ember)":                      "EUROPE_EMBER",
+	"European Union (27)":                 "EU",
+	"G20 (Ember)":                         "G20",
+	"G7 (Ember)":                          "G7",
+	"High-income countries":               "HIGH_INCOME",
+	"Latin America and Caribbean (Ember)": "LATIN_AMERICA_CARIBBEAN",
+	"Low-income countries":                "LOW_INCOME",
+	"Lower-middle-income countries":       "LOWER_MIDDLE_INCOME",
+	"Middle East (Ember)":                 "MIDDLE_EAST",
+	"North America":                       "NORTH_AMERICA",
+	"North America (Ember)":               "NORTH_AMERICA_EMBER",
+	"OECD (Ember)":                        "OECD",
+	"Oceania":                             "OCEANIA",
+	"Oceania (Ember)":                     "OCEANIA_EMBER",
+	"South America":                       "SOUTH_AMERICA",
+	"Upper-middle-income countries":       "UPPER_MIDDLE_INCOME",
+}
+
+// CarbonIntensityDataset is the carbon intensity [gCO2e/kWh] time series of the regions
+type CarbonIntensityDataset struct {
+	Source      string
+	RetrievedAt time.Time // Zero if unknown
+	// Carbon intensity of the latest year, keyed by region
+	Latest map[string]CarbonIntensity
+	// Carbon intensity of all the available years sorted by year, keyed by region
+	Series map[string][]CarbonIntensity
+	// Names of the regions, keyed by region
+	Names map[string]string
+}
+
+// Metadata comments at the beginning of the dataset files
+const (
+	SourceComment    = "# Source: "
+	RetrievedComment = "# Retrieved: "
+)
+
+func (d *CarbonIntensityDataset) add(region, name string, year int, value float64) {
+	carbonIntensity := CarbonIntensity{
+		Region: region,
+		Year:   year,
+		Value:  value,
+	}
+	d.Series[region] = append(d.Series[region], carbonIntensity)
+	d.Names[region] = name
+	if latest, ok := d.Latest[region]; !ok || year > latest.Year {
+		d.Latest[region] = carbonIntensity
+	}
+}
+
+// Merge adds the regions of the other dataset that are not in the dataset
+func (d *CarbonIntensityDataset) Merge(other *CarbonIntensityDataset) {
+	for region, series := range other.Series {
+		if _, ok := d.Series[region]; ok {
+			continue
+		}
+		d.Series[region] = series
+		d.Latest[region] = other.Latest[region]
+		d.Names[region] = other.Names[region]
+	}
+}
+
+// readDatasetMetadata reads the source and retrieval time comments
+// at the beginning of the dataset
+func readDatasetMetadata(r *bufio.Reader, dataset *CarbonIntensityDataset) error {
+	for {
+		b, err := r.Peek(1)
+		if err != nil || b[0] != '#' {
+			return nil
+		}
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, strings.TrimSpace(SourceComment)):
+			dataset.Source = strings.TrimSpace(strings.TrimPrefix(line, strings.TrimSpace(SourceComment)))
+		case strings.HasPrefix(line, strings.TrimSpace(RetrievedComment)):
+			retrieved := strings.TrimSpace(strings.TrimPrefix(line, strings.TrimSpace(RetrievedComment)))
+			dataset.RetrievedAt, err = time.Parse(time.RFC3339, retrieved)
+			if err != nil {
+				return fmt.Errorf("parse retrieval time: %w", err)
+			}
+		}
+	}
+}
+
+// ReadCarbonIntensityDataset reads the carbon intensity dataset in the OWID grapher format
+// (Entity,Code,Year,value) or the simple format (region,year,value), with or without the header.
+// Aggregate regions of the OWID format are keyed by AggregateRegionIDs, the unknown ones are skipped.
+func ReadCarbonIntensityDataset(r io.Reader) (*CarbonIntensityDataset, error) {
+	dataset := &CarbonIntensityDataset{
+		Latest: map[string]CarbonIntensity{},
+		Series: map[string][]CarbonIntensity{},
+		Names:  map[string]string{},
+	}
+
+	bufReader := bufio.NewReader(r)
+	if err := readDatasetMetadata(bufReader, dataset); err != nil {
+		return nil, fmt.Errorf("read metadata: %w", err)
+	}
+	csvReader := csv.NewReader(bufReader)
+	csvReader.Comment = '#'
+
+	// Column indices of the entity, code, year and value
+	entityColumn, codeColumn, yearColumn, valueColumn := -1, -1, -1, -1
+	for line := 1; ; line++ {
+		row, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read dataset: %w", err)
+		}
+
+		if yearColumn == -1 {
+			switch {
+			case len(row) >= 4 && row[0] == "Entity":
+				// OWID grapher header, the columns after the value are annotations
+				entityColumn, codeColumn, yearColumn = 0, 1, 2
+				valueColumn = 3
+				continue
+			case len(row) == 4:
+				entityColumn, codeColumn, yearColumn, valueColumn = 0, 1, 2, 3
+			case len(row) == 3:
+				codeColumn, yearColumn, valueColumn = 0, 1, 2
+				// Skip the header of the simple format
+				if _, err := strconv.Atoi(row[1]); err != nil {
+					continue
+				}
+			default:
+				return nil, fmt.Errorf("line %d: unknown dataset format", line)
+			}
+		}
+		if len(row) <= valueColumn {
+			return nil, fmt.Errorf("line %d: invalid record length", line)
+		}
+
+		region := row[codeColumn]
+		name := region
+		if entityColumn != -1 {
+			name = row[entityColumn]
+		}
+		// Aggregate regions have no code
+		if region == "" {
+			id, ok := AggregateRegionIDs[name]
+			if !ok {
+				continue
+			}
+			region = id
+		}
+		year, err := strconv.Atoi(row[yearColumn])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: parse year: %w", line, err)
+		}
+		value, err := strconv.ParseFloat(row[valueColumn], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: parse carbon intensity: %w", line, err)
+		}
+		if value < 0 {
+			return nil, fmt.Errorf("line %d: negative carbon intensity", line)
+		}
+		dataset.add(region, name, year, value)
+	}
+	if len(dataset.Series) == 0 {
+		return nil, errors.New("no carbon intensity data")
+	}
+
+	for _, series := range dataset.Series {
+		sort.Slice(series, func(i, j int) bool {
+			return series[i].Year < series[j].Year
+		})
+	}
+	return dataset, nil
+}
@@ -0,0 +1,33 @@
+package data
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"strings"
+)
+
+//go:embed iso3166.csv
+var iso3166CSVData string
+
+var (
+	// Region codes of the countries keyed by their ISO 3166-1 alpha-2 codes
+	RegionAlpha2 = map[string]string{}
+)
+
+func readISO3166() {
+	reader := strings.NewReader(iso3166CSVData)
+	csvReader := csv.NewReader(reader)
+	csvReader.Comment = '#'
+
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		panic(err)
+	}
+	for _, row := range records {
+		RegionAlpha2[row[0]] = row[1]
+	}
+}
+
+func init() {
+	readISO3166()
+}
@@ -0,0 +1,21 @@
+package data
+
+import (
+	_ "embed"
+	"strings"
+)
+
+//go:embed subregions.csv
+var subregionsCSVData string
+
+// SubregionSeparator separates the country code and the subregion code, e.g., USA-ERCT
+const SubregionSeparator = "-"
+
+func readSubregionCarbonIntensities() *CarbonIntensityDataset {
+	dataset, err := ReadCarbonIntensityDataset(strings.NewReader(subregionsCSVData))
+	if err != nil {
+		panic(err)
+	}
+	dataset.Source = "US EPA eGRID2022; ECCC National Inventory Report (2024); DCCEEW National Greenhouse Accounts Factors (2024); CEA CO2 Baseline Database (2023, 2024)"
+	return dataset
+}
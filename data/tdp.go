@@ -0,0 +1,109 @@
+package data
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"strconv"
+	"strings"
+)
+
+// Curated TDP values per core of common server CPUs, keyed by the CPUID brand string
+
+//go:embed tdp.csv
+var tdpCSVData string
+
+type TDP struct {
+	CPUString    string
+	Watts        float64 // Per core
+	Source       string
+	PackageWatts float64
+	Cores        int
+	Threads      int
+	BaseClockGHz float64
+	// Optional, zero if not a hybrid CPU or no configurable TDP
+	PerformanceCores int
+	EfficiencyCores  int
+	TDPDownWatts     float64
+	TDPUpWatts       float64
+}
+
+var (
+	TDPs = map[string]TDP{}
+)
+
+func atoiOptional(s string) int {
+	if s == "" {
+		return 0
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func parseFloatOptional(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func readTDPs() {
+	reader := strings.NewReader(tdpCSVData)
+	csvReader := csv.NewReader(reader)
+	csvReader.Comment = '#'
+	csvReader.FieldsPerRecord = -1
+
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		panic(err)
+	}
+	for _, row := range records {
+		cpuString := row[0]
+		watts, err := strconv.ParseFloat(row[1], 64)
+		if err != nil {
+			panic(err)
+		}
+		packageWatts, err := strconv.ParseFloat(row[3], 64)
+		if err != nil {
+			panic(err)
+		}
+		cores, err := strconv.Atoi(row[4])
+		if err != nil {
+			panic(err)
+		}
+		threads, err := strconv.Atoi(row[5])
+		if err != nil {
+			panic(err)
+		}
+		baseClock, err := strconv.ParseFloat(row[6], 64)
+		if err != nil {
+			panic(err)
+		}
+		tdp := TDP{
+			CPUString:    cpuString,
+			Watts:        watts,
+			Source:       row[2],
+			PackageWatts: packageWatts,
+			Cores:        cores,
+			Threads:      threads,
+			BaseClockGHz: baseClock,
+		}
+		if len(row) >= 11 {
+			tdp.PerformanceCores = atoiOptional(row[7])
+			tdp.EfficiencyCores = atoiOptional(row[8])
+			tdp.TDPDownWatts = parseFloatOptional(row[9])
+			tdp.TDPUpWatts = parseFloatOptional(row[10])
+		}
+		TDPs[cpuString] = tdp
+	}
+}
+
+func init() {
+	readTDPs()
+}
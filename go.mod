@@ -5,6 +5,7 @@ go 1.22.0
 toolchain go1.23.0
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/blaze2305/partial-json-parser v0.1.1
 	github.com/klauspost/cpuid/v2 v2.2.8
 	github.com/minio/selfupdate v0.6.0
@@ -15,7 +16,6 @@ require (
 
 require (
 	aead.dev/minisign v0.2.0 // indirect
-	github.com/BurntSushi/toml v1.4.0 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.5 // indirect
 	github.com/creack/pty v1.1.23 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
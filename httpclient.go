@@ -0,0 +1,156 @@
+package calcium
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultHTTPTimeout limits each request, including reading the response body
+	DefaultHTTPTimeout = 30 * time.Second
+	// DefaultHTTPRetries is the number of retries after the first attempt
+	DefaultHTTPRetries = 2
+	// DefaultHTTPBackoff is the delay before the first retry, doubled for each next one
+	DefaultHTTPBackoff = time.Second
+
+	UserAgent = "calcium (+https://github.com/unkaktus/calcium)"
+)
+
+// HTTPStatusError is returned for responses with 4xx and 5xx status codes
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s: status %s", e.URL, e.Status)
+}
+
+// retryable tells whether the request can succeed if retried
+func (e *HTTPStatusError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// HTTPClient does all the network access of the TDP lookup.
+// The proxy is taken from the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.
+type HTTPClient struct {
+	Timeout   time.Duration     // DefaultHTTPTimeout if zero
+	Retries   int               // No retries if zero
+	Backoff   time.Duration     // Retries right away if zero
+	UserAgent string            // UserAgent if empty
+	Transport http.RoundTripper // http.DefaultTransport if nil
+}
+
+// NewHTTPClient returns the client with the default settings
+func NewHTTPClient() *HTTPClient {
+	return &HTTPClient{
+		Timeout:   DefaultHTTPTimeout,
+		Retries:   DefaultHTTPRetries,
+		Backoff:   DefaultHTTPBackoff,
+		UserAgent: UserAgent,
+	}
+}
+
+// DefaultHTTPClient is used when no client is given
+var DefaultHTTPClient = NewHTTPClient()
+
+func (c *HTTPClient) httpClient(followRedirects bool) *http.Client {
+	// The zero value never hangs either
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultHTTPTimeout
+	}
+	client := &http.Client{
+		Transport: c.Transport,
+		Timeout:   timeout,
+	}
+	if !followRedirects {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
+
+func (c *HTTPClient) do(ctx context.Context, u string, followRedirects bool) (*http.Response, []byte, error) {
+	client := c.httpClient(followRedirects)
+	backoff := c.Backoff
+	var lastErr error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, http.NoBody)
+		if err != nil {
+			return nil, nil, fmt.Errorf("create request: %w", err)
+		}
+		userAgent := c.UserAgent
+		if userAgent == "" {
+			userAgent = UserAgent
+		}
+		req.Header.Set("User-Agent", userAgent)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("read body: %w", err)
+			continue
+		}
+		if resp.StatusCode >= 400 {
+			statusErr := &HTTPStatusError{
+				URL:        u,
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+			}
+			if !statusErr.retryable() {
+				return nil, nil, statusErr
+			}
+			lastErr = statusErr
+			continue
+		}
+		return resp, body, nil
+	}
+	return nil, nil, lastErr
+}
+
+// Get fetches the page following the redirects, retrying on network errors,
+// 429 and 5xx responses. Other 4xx responses fail with HTTPStatusError.
+func (c *HTTPClient) Get(ctx context.Context, u string) ([]byte, error) {
+	_, body, err := c.do(ctx, u, true)
+	return body, err
+}
+
+// GetRedirect returns the location the page redirects to, without following it
+func (c *HTTPClient) GetRedirect(ctx context.Context, u string) (string, error) {
+	resp, _, err := c.do(ctx, u, false)
+	if err != nil {
+		return "", err
+	}
+	location, err := resp.Location()
+	if errors.Is(err, http.ErrNoLocation) {
+		return "", fmt.Errorf("no redirect: status %s", resp.Status)
+	}
+	if err != nil {
+		return "", fmt.Errorf("get location: %w", err)
+	}
+	return location.String(), nil
+}
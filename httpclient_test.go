@@ -0,0 +1,123 @@
+package calcium
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// statusServer responds with the statuses in turn, and with 200 after them
+func statusServer(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	requests := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+		if n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestHTTPClientGet(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		status   int // Status of the HTTPStatusError, zero if the request succeeds
+		requests int32
+	}{
+		{"success", nil, 0, 1},
+		{"not found", []int{http.StatusNotFound}, http.StatusNotFound, 1},
+		{"forbidden", []int{http.StatusForbidden}, http.StatusForbidden, 1},
+		{"unavailable", []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}, 0, 3},
+		{"too many requests", []int{http.StatusTooManyRequests}, 0, 2},
+		{"retries exhausted", []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}, http.StatusBadGateway, 3},
+	}
+	for _, test := range tests {
+		server, requests := statusServer(t, test.statuses...)
+		client := &HTTPClient{
+			Retries: 2,
+			Backoff: time.Millisecond,
+		}
+		body, err := client.Get(context.Background(), server.URL)
+		if test.status == 0 {
+			if err != nil {
+				t.Errorf("%s: Get: %v", test.name, err)
+			} else if string(body) != "ok" {
+				t.Errorf("%s: got body %q, want ok", test.name, body)
+			}
+		} else {
+			statusErr := &HTTPStatusError{}
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != test.status {
+				t.Errorf("%s: got error %v, want status %d", test.name, err, test.status)
+			}
+		}
+		if n := requests.Load(); n != test.requests {
+			t.Errorf("%s: got %d requests, want %d", test.name, n, test.requests)
+		}
+	}
+}
+
+func TestHTTPClientUserAgent(t *testing.T) {
+	userAgents := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents <- r.UserAgent()
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		client *HTTPClient
+		want   string
+	}{
+		{&HTTPClient{}, UserAgent},
+		{NewHTTPClient(), UserAgent},
+		{&HTTPClient{UserAgent: "test"}, "test"},
+	}
+	for _, test := range tests {
+		if _, err := test.client.Get(context.Background(), server.URL); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if userAgent := <-userAgents; userAgent != test.want {
+			t.Errorf("got User-Agent %q, want %q", userAgent, test.want)
+		}
+	}
+}
+
+func TestHTTPClientZeroTimeout(t *testing.T) {
+	client := &HTTPClient{}
+	if timeout := client.httpClient(true).Timeout; timeout != DefaultHTTPTimeout {
+		t.Errorf("got timeout %v, want %v", timeout, DefaultHTTPTimeout)
+	}
+}
+
+func TestHTTPClientGetRedirect(t *testing.T) {
+	const location = "https://www.intel.com/content/www/us/en/products/sku/120489.html"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, location, http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := &HTTPClient{}
+	got, err := client.GetRedirect(context.Background(), server.URL+"/redirect")
+	if err != nil {
+		t.Fatalf("GetRedirect: %v", err)
+	}
+	if got != location {
+		t.Errorf("got location %q, want %q", got, location)
+	}
+
+	if got, err := client.GetRedirect(context.Background(), server.URL+"/page"); err == nil {
+		t.Errorf("got location %q for a page without redirect, want error", got)
+	}
+}
@@ -0,0 +1,126 @@
+package calcium
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/unkaktus/calcium/data"
+)
+
+// OWIDCarbonIntensityURL is the carbon intensity dataset by Ember,
+// Energy Institute and Our World in Data in the grapher format
+const OWIDCarbonIntensityURL = "https://ourworldindata.org/grapher/carbon-intensity-electricity.csv"
+
+func carbonIntensityFilename() (string, error) {
+	calciumDir, err := getCalciumDir()
+	if err != nil {
+		return "", fmt.Errorf("get calcium directory: %w", err)
+	}
+	return filepath.Join(calciumDir, "carbon-intensity.csv"), nil
+}
+
+// ReadCarbonIntensityFile reads the carbon intensity dataset from the file
+// in the OWID grapher or the simple region,year,value format.
+// The source is the filename unless it is recorded in the file.
+func ReadCarbonIntensityFile(filename string) (*data.CarbonIntensityDataset, error) {
+	datasetFile, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open dataset file: %w", err)
+	}
+	defer datasetFile.Close()
+
+	dataset, err := data.ReadCarbonIntensityDataset(datasetFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(filename), err)
+	}
+	if dataset.Source == "" {
+		dataset.Source = filename
+	}
+	return dataset, nil
+}
+
+// DefaultCarbonIntensityData returns the dataset downloaded by UpdateCarbonIntensityData
+// to the calcium directory, or the embedded dataset if there is none.
+// Both include the bundled subnational grid regions.
+func DefaultCarbonIntensityData() (*data.CarbonIntensityDataset, error) {
+	filename, err := carbonIntensityFilename()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		return data.EmbeddedCarbonIntensityData, nil
+	}
+	dataset, err := ReadCarbonIntensityFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	dataset.Merge(data.SubregionCarbonIntensityData)
+	return dataset, nil
+}
+
+// validateCarbonIntensityData checks that the downloaded dataset is complete
+func validateCarbonIntensityData(dataset *data.CarbonIntensityDataset) error {
+	if _, ok := dataset.Series["OWID_WRL"]; !ok {
+		return fmt.Errorf("no world data")
+	}
+	if len(dataset.Series) < len(data.EmbeddedCarbonIntensityData.Series)/2 {
+		return fmt.Errorf("only %d regions", len(dataset.Series))
+	}
+	return nil
+}
+
+// UpdateCarbonIntensityData downloads the latest OWID dataset to the calcium directory,
+// where it is used instead of the embedded one. The dataset is validated before
+// replacing the previous one. DefaultHTTPClient is used if client is nil.
+func UpdateCarbonIntensityData(ctx context.Context, client *HTTPClient) (*data.CarbonIntensityDataset, error) {
+	if client == nil {
+		client = DefaultHTTPClient
+	}
+	body, err := client.Get(ctx, OWIDCarbonIntensityURL)
+	if err != nil {
+		return nil, fmt.Errorf("download dataset: %w", err)
+	}
+
+	retrievedAt := time.Now().UTC().Truncate(time.Second)
+	datasetData := &bytes.Buffer{}
+	fmt.Fprintf(datasetData, "%s%s\n", data.SourceComment, OWIDCarbonIntensityURL)
+	fmt.Fprintf(datasetData, "%s%s\n", data.RetrievedComment, retrievedAt.Format(time.RFC3339))
+	datasetData.Write(body)
+
+	dataset, err := data.ReadCarbonIntensityDataset(bytes.NewReader(datasetData.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("read dataset: %w", err)
+	}
+	if err := validateCarbonIntensityData(dataset); err != nil {
+		return nil, fmt.Errorf("validate dataset: %w", err)
+	}
+
+	filename, err := carbonIntensityFilename()
+	if err != nil {
+		return nil, err
+	}
+	datasetFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return nil, fmt.Errorf("create dataset file: %w", err)
+	}
+	defer os.Remove(datasetFile.Name())
+	defer datasetFile.Close()
+	if err := datasetFile.Chmod(0775); err != nil {
+		return nil, fmt.Errorf("set dataset file mode: %w", err)
+	}
+	if _, err := datasetFile.Write(datasetData.Bytes()); err != nil {
+		return nil, fmt.Errorf("write dataset file: %w", err)
+	}
+	if err := datasetFile.Close(); err != nil {
+		return nil, fmt.Errorf("close dataset file: %w", err)
+	}
+	if err := os.Rename(datasetFile.Name(), filename); err != nil {
+		return nil, fmt.Errorf("replace dataset file: %w", err)
+	}
+	return dataset, nil
+}
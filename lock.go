@@ -0,0 +1,25 @@
+package calcium
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile acquires the exclusive lock of the file and returns the function
+// releasing it. The lock is taken on a separate lock file, so that it
+// is held across the rewrites of the file by renaming.
+func lockFile(filename string) (func(), error) {
+	lock, err := os.OpenFile(filename+".lock", os.O_CREATE|os.O_RDWR, 0775)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file: %w", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("acquire lock: %w", err)
+	}
+	return func() {
+		syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		lock.Close()
+	}, nil
+}
@@ -0,0 +1,493 @@
+package calcium
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogSchemaVersion is the version of the log layout written by WriteLog,
+// which is bumped whenever a column is added. Logs without the version comment
+// and header are of version 1, version 2 adds them along with Energy,
+// 3 adds ThreadsPerCore, 4 adds CPUModel, and 5 adds Host.
+const LogSchemaVersion = 5
+
+const logSchemaComment = "# calcium log schema "
+
+type LogFormat string
+
+const (
+	LogFormatCSV   LogFormat = "csv"
+	LogFormatJSONL LogFormat = "jsonl"
+)
+
+// LogFormats are all the supported log formats
+var LogFormats = []LogFormat{LogFormatCSV, LogFormatJSONL}
+
+// ParseLogFormat validates the log format name
+func ParseLogFormat(s string) (LogFormat, error) {
+	for _, format := range LogFormats {
+		if s == string(format) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("unknown log format %q", s)
+}
+
+// defaultLogFilename returns the filename of the log in the calcium directory
+func defaultLogFilename(format LogFormat) (string, error) {
+	calciumDir, err := getCalciumDir()
+	if err != nil {
+		return "", fmt.Errorf("get calcium directory: %w", err)
+	}
+	return filepath.Join(calciumDir, "log."+string(format)), nil
+}
+
+// DefaultLogFilenames returns the filenames of the existing logs in the calcium directory
+func DefaultLogFilenames() ([]string, error) {
+	filenames := []string{}
+	for _, format := range LogFormats {
+		filename, err := defaultLogFilename(format)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		filenames = append(filenames, filename)
+	}
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("no log files found")
+	}
+	return filenames, nil
+}
+
+// logColumns are the names of the log columns in the order they are written.
+// New columns must only be appended, so that headerless logs can
+// still be read positionally.
+var logColumns = []string{
+	"Timestamp",
+	"CPU",
+	"Tag",
+	"UserCPUTime",
+	"SystemCPUTime",
+	"ExitCode",
+	"StartTime",
+	"WallTime",
+	"MaxRSS",
+	"InBlock",
+	"OutBlock",
+	"VoluntaryContextSwitches",
+	"InvoluntaryContextSwitches",
+	"Energy",
+	"ThreadsPerCore",
+	"CPUModel",
+	"Host",
+}
+
+// requiredLogColumns are present in all the log layouts
+var requiredLogColumns = logColumns[:5]
+
+// LogRecord is a single run in the log.
+// Fields missing in older layouts are left zero.
+type LogRecord struct {
+	Timestamp                  time.Time // End of the run
+	CPU                        string
+	Tag                        string
+	UserCPUTime                time.Duration
+	SystemCPUTime              time.Duration
+	ExitCode                   int
+	StartTime                  time.Time
+	WallTime                   time.Duration
+	MaxRSS                     int64 // [bytes]
+	InBlock                    int64
+	OutBlock                   int64
+	VoluntaryContextSwitches   int64
+	InvoluntaryContextSwitches int64
+	EnergyMeasured             bool
+	Energy                     float64 // [J]
+	ThreadsPerCore             int     // Zero if unknown
+	CPUModel                   string  // Canonical model identifier of CPU, empty in older logs
+	Host                       string  // Hostname of the run, empty in older logs
+}
+
+// jsonLogRecord is the representation of LogRecord in JSON Lines logs
+type jsonLogRecord struct {
+	Schema                     int
+	Timestamp                  time.Time
+	CPU                        string
+	Tag                        string
+	UserCPUTime                float64 // [s]
+	SystemCPUTime              float64 // [s]
+	ExitCode                   int
+	StartTime                  time.Time
+	WallTime                   float64 // [s]
+	MaxRSS                     int64   // [bytes]
+	InBlock                    int64
+	OutBlock                   int64
+	VoluntaryContextSwitches   int64
+	InvoluntaryContextSwitches int64
+	Energy                     *float64 `json:",omitempty"` // [J]
+	ThreadsPerCore             int      `json:",omitempty"`
+	CPUModel                   string   `json:",omitempty"`
+	Host                       string   `json:",omitempty"`
+}
+
+func formatJSONLogRecord(record LogRecord) (string, error) {
+	jsonRecord := jsonLogRecord{
+		Schema:                     LogSchemaVersion,
+		Timestamp:                  record.Timestamp,
+		CPU:                        record.CPU,
+		Tag:                        record.Tag,
+		UserCPUTime:                record.UserCPUTime.Seconds(),
+		SystemCPUTime:              record.SystemCPUTime.Seconds(),
+		ExitCode:                   record.ExitCode,
+		StartTime:                  record.StartTime,
+		WallTime:                   record.WallTime.Seconds(),
+		MaxRSS:                     record.MaxRSS,
+		InBlock:                    record.InBlock,
+		OutBlock:                   record.OutBlock,
+		VoluntaryContextSwitches:   record.VoluntaryContextSwitches,
+		InvoluntaryContextSwitches: record.InvoluntaryContextSwitches,
+		ThreadsPerCore:             record.ThreadsPerCore,
+		CPUModel:                   record.CPUModel,
+		Host:                       record.Host,
+	}
+	if record.EnergyMeasured {
+		jsonRecord.Energy = &record.Energy
+	}
+	jsonData, err := json.Marshal(jsonRecord)
+	if err != nil {
+		return "", err
+	}
+	return string(jsonData), nil
+}
+
+func parseJSONLogRecord(data []byte) (*LogRecord, error) {
+	jsonRecord := &jsonLogRecord{}
+	if err := json.Unmarshal(data, jsonRecord); err != nil {
+		return nil, err
+	}
+	if jsonRecord.Schema > LogSchemaVersion {
+		return nil, fmt.Errorf("unsupported schema version %d", jsonRecord.Schema)
+	}
+	record := &LogRecord{
+		Timestamp:                  jsonRecord.Timestamp,
+		CPU:                        jsonRecord.CPU,
+		Tag:                        jsonRecord.Tag,
+		UserCPUTime:                time.Duration(jsonRecord.UserCPUTime * float64(time.Second)),
+		SystemCPUTime:              time.Duration(jsonRecord.SystemCPUTime * float64(time.Second)),
+		ExitCode:                   jsonRecord.ExitCode,
+		StartTime:                  jsonRecord.StartTime,
+		WallTime:                   time.Duration(jsonRecord.WallTime * float64(time.Second)),
+		MaxRSS:                     jsonRecord.MaxRSS,
+		InBlock:                    jsonRecord.InBlock,
+		OutBlock:                   jsonRecord.OutBlock,
+		VoluntaryContextSwitches:   jsonRecord.VoluntaryContextSwitches,
+		InvoluntaryContextSwitches: jsonRecord.InvoluntaryContextSwitches,
+		ThreadsPerCore:             jsonRecord.ThreadsPerCore,
+		CPUModel:                   jsonRecord.CPUModel,
+		Host:                       jsonRecord.Host,
+	}
+	if jsonRecord.Energy != nil {
+		record.Energy = *jsonRecord.Energy
+		record.EnergyMeasured = true
+	}
+	return record, nil
+}
+
+func formatSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.2f", d.Seconds())
+}
+
+func parseSeconds(s string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func formatTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.DateTime)
+}
+
+func parseTimestamp(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation(time.DateTime, s, time.Local)
+}
+
+func writeCSVLogHeader(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%s%d\n", logSchemaComment, LogSchemaVersion); err != nil {
+		return err
+	}
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write(logColumns)
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+func logRecordRow(record LogRecord) []string {
+	// Energy is left empty if it was not measured
+	energy := ""
+	if record.EnergyMeasured {
+		energy = fmt.Sprintf("%.2f", record.Energy)
+	}
+
+	return []string{
+		formatTimestamp(record.Timestamp),
+		record.CPU,
+		record.Tag,
+		formatSeconds(record.UserCPUTime),
+		formatSeconds(record.SystemCPUTime),
+		strconv.Itoa(record.ExitCode),
+		formatTimestamp(record.StartTime),
+		formatSeconds(record.WallTime),
+		strconv.FormatInt(record.MaxRSS, 10),
+		strconv.FormatInt(record.InBlock, 10),
+		strconv.FormatInt(record.OutBlock, 10),
+		strconv.FormatInt(record.VoluntaryContextSwitches, 10),
+		strconv.FormatInt(record.InvoluntaryContextSwitches, 10),
+		energy,
+		strconv.Itoa(record.ThreadsPerCore),
+		record.CPUModel,
+		record.Host,
+	}
+}
+
+func parseLogRecord(columns, row []string) (*LogRecord, error) {
+	if len(row) > len(columns) {
+		return nil, fmt.Errorf("more fields than columns")
+	}
+	fields := map[string]string{}
+	for i, value := range row {
+		fields[columns[i]] = value
+	}
+	for _, column := range requiredLogColumns {
+		if _, ok := fields[column]; !ok {
+			return nil, fmt.Errorf("missing %s", column)
+		}
+	}
+
+	record := &LogRecord{
+		CPU: fields["CPU"],
+		Tag: fields["Tag"],
+	}
+	var err error
+	// Unknown columns are ignored
+	for column, value := range fields {
+		switch column {
+		case "Timestamp":
+			record.Timestamp, err = parseTimestamp(value)
+		case "UserCPUTime":
+			record.UserCPUTime, err = parseSeconds(value)
+		case "SystemCPUTime":
+			record.SystemCPUTime, err = parseSeconds(value)
+		case "ExitCode":
+			record.ExitCode, err = strconv.Atoi(value)
+		case "StartTime":
+			record.StartTime, err = parseTimestamp(value)
+		case "WallTime":
+			record.WallTime, err = parseSeconds(value)
+		case "MaxRSS":
+			record.MaxRSS, err = strconv.ParseInt(value, 10, 64)
+		case "InBlock":
+			record.InBlock, err = strconv.ParseInt(value, 10, 64)
+		case "OutBlock":
+			record.OutBlock, err = strconv.ParseInt(value, 10, 64)
+		case "VoluntaryContextSwitches":
+			record.VoluntaryContextSwitches, err = strconv.ParseInt(value, 10, 64)
+		case "InvoluntaryContextSwitches":
+			record.InvoluntaryContextSwitches, err = strconv.ParseInt(value, 10, 64)
+		case "Energy":
+			if value != "" {
+				record.Energy, err = strconv.ParseFloat(value, 64)
+				record.EnergyMeasured = true
+			}
+		case "ThreadsPerCore":
+			record.ThreadsPerCore, err = strconv.Atoi(value)
+		case "CPUModel":
+			record.CPUModel = value
+		case "Host":
+			record.Host = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", column, err)
+		}
+	}
+	return record, nil
+}
+
+// ReadLog reads the log records in any of the log formats and layouts.
+func ReadLog(r io.Reader) ([]LogRecord, error) {
+	bufReader := bufio.NewReader(r)
+	for {
+		b, err := bufReader.Peek(1)
+		if err == io.EOF {
+			return []LogRecord{}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read log: %w", err)
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			bufReader.ReadByte()
+			continue
+		case '{':
+			return readJSONLog(bufReader)
+		}
+		return readCSVLog(bufReader)
+	}
+}
+
+// ReadLogFile reads the log records from the log file
+func ReadLogFile(filename string) ([]LogRecord, error) {
+	logFile, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open log file: %w", err)
+	}
+	defer logFile.Close()
+
+	return ReadLog(logFile)
+}
+
+func readJSONLog(r io.Reader) ([]LogRecord, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+
+	records := []LogRecord{}
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		record, err := parseJSONLogRecord(scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, *record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read log: %w", err)
+	}
+	return records, nil
+}
+
+// csvLogLayout tracks the layout of a CSV log while reading it.
+// Headerless rows are read positionally, and the header row
+// switches to reading the columns by name.
+type csvLogLayout struct {
+	columns []string
+}
+
+func newCSVLogLayout() *csvLogLayout {
+	return &csvLogLayout{
+		columns: logColumns,
+	}
+}
+
+// parseRow returns the log record in the row,
+// or nil if the row is a comment or a header.
+func (l *csvLogLayout) parseRow(row []string) (*LogRecord, error) {
+	if strings.HasPrefix(row[0], "#") {
+		if !strings.HasPrefix(row[0], logSchemaComment) {
+			return nil, nil
+		}
+		version, err := strconv.Atoi(strings.TrimPrefix(row[0], logSchemaComment))
+		if err != nil {
+			return nil, fmt.Errorf("parse schema version: %w", err)
+		}
+		if version > LogSchemaVersion {
+			return nil, fmt.Errorf("unsupported schema version %d", version)
+		}
+		return nil, nil
+	}
+	if row[0] == logColumns[0] {
+		l.columns = row
+		return nil, nil
+	}
+	return parseLogRecord(l.columns, row)
+}
+
+// readCSVLogSchemaVersion returns the schema version of the last rows of the CSV log,
+// which is the one of the last schema comment, 1 if there is none,
+// or zero if the log is empty.
+func readCSVLogSchemaVersion(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+
+	version := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, logSchemaComment) {
+			var err error
+			version, err = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, logSchemaComment)))
+			if err != nil {
+				return 0, fmt.Errorf("parse schema version: %w", err)
+			}
+			continue
+		}
+		if version == 0 && strings.TrimSpace(line) != "" {
+			version = 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// needsCSVLogHeader tells whether the rows appended to the CSV log need
+// the schema comment and header first, as the log is new or its last rows
+// are of another schema. The rows of older schemas are kept as they are,
+// since the reader switches the layout at each header.
+func needsCSVLogHeader(filename string) bool {
+	logFile, err := os.Open(filename)
+	if err != nil {
+		return true
+	}
+	defer logFile.Close()
+
+	version, err := readCSVLogSchemaVersion(logFile)
+	// A redundant header is harmless, so it is written if in doubt
+	return err != nil || version != LogSchemaVersion
+}
+
+func readCSVLog(r io.Reader) ([]LogRecord, error) {
+	csvReader := csv.NewReader(r)
+	csvReader.FieldsPerRecord = -1
+
+	layout := newCSVLogLayout()
+	records := []LogRecord{}
+	for {
+		row, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read log: %w", err)
+		}
+		line, _ := csvReader.FieldPos(0)
+
+		record, err := layout.parseRow(row)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if record != nil {
+			records = append(records, *record)
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,147 @@
+package calcium
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadLog(t *testing.T) {
+	timestamp := time.Date(2024, 1, 2, 10, 0, 0, 0, time.Local)
+	startTime := time.Date(2024, 1, 2, 9, 0, 0, 0, time.Local)
+	header := "Timestamp,CPU,Tag,UserCPUTime,SystemCPUTime,ExitCode,StartTime,WallTime,MaxRSS,InBlock,OutBlock," +
+		"VoluntaryContextSwitches,InvoluntaryContextSwitches,Energy,ThreadsPerCore,CPUModel,Host\n"
+	tests := []struct {
+		name    string
+		log     string
+		records []LogRecord
+	}{
+		{
+			name: "empty",
+			log:  "",
+		},
+		{
+			name: "headerless with the quoted CPU",
+			log:  "2024-01-02 10:00:00,\"Intel(R) Xeon(R) Gold 6148 CPU @ 2.40GHz\",sim,12.50,1.20\n",
+			records: []LogRecord{{
+				Timestamp:     timestamp,
+				CPU:           "Intel(R) Xeon(R) Gold 6148 CPU @ 2.40GHz",
+				Tag:           "sim",
+				UserCPUTime:   12500 * time.Millisecond,
+				SystemCPUTime: 1200 * time.Millisecond,
+			}},
+		},
+		{
+			name: "schema comment and header",
+			log: "# calcium log schema 5\n" + header +
+				"2024-01-02 10:00:00,AMD EPYC 7763 64-Core Processor,\"a,b\",3.00,1.00,2,2024-01-02 09:00:00,3600.00," +
+				"1000,1,2,3,4,36000.00,2,AMD EPYC 7763,node1\n",
+			records: []LogRecord{{
+				Timestamp:                  timestamp,
+				CPU:                        "AMD EPYC 7763 64-Core Processor",
+				Tag:                        "a,b",
+				UserCPUTime:                3 * time.Second,
+				SystemCPUTime:              time.Second,
+				ExitCode:                   2,
+				StartTime:                  startTime,
+				WallTime:                   time.Hour,
+				MaxRSS:                     1000,
+				InBlock:                    1,
+				OutBlock:                   2,
+				VoluntaryContextSwitches:   3,
+				InvoluntaryContextSwitches: 4,
+				EnergyMeasured:             true,
+				Energy:                     36000,
+				ThreadsPerCore:             2,
+				CPUModel:                   "AMD EPYC 7763",
+				Host:                       "node1",
+			}},
+		},
+		{
+			name: "headerless rows followed by a header",
+			log: "2024-01-02 10:00:00,\"Test CPU\",old,1.00,0.00\n" +
+				"# calcium log schema 2\n" +
+				"Timestamp,CPU,Tag,UserCPUTime,SystemCPUTime,ExitCode,StartTime,WallTime,MaxRSS,InBlock,OutBlock," +
+				"VoluntaryContextSwitches,InvoluntaryContextSwitches,Energy\n" +
+				"2024-01-02 10:00:00,Test CPU,new,2.00,0.00,1,2024-01-02 09:00:00,3600.00,0,0,0,0,0,\n",
+			records: []LogRecord{
+				{
+					Timestamp:   timestamp,
+					CPU:         "Test CPU",
+					Tag:         "old",
+					UserCPUTime: time.Second,
+				},
+				{
+					Timestamp:   timestamp,
+					CPU:         "Test CPU",
+					Tag:         "new",
+					UserCPUTime: 2 * time.Second,
+					ExitCode:    1,
+					StartTime:   startTime,
+					WallTime:    time.Hour,
+				},
+			},
+		},
+		{
+			name: "JSON Lines",
+			log: "\n{\"Schema\":5,\"Timestamp\":\"2024-01-02T10:00:00Z\",\"CPU\":\"Test CPU\",\"Tag\":\"a\"," +
+				"\"UserCPUTime\":1.5,\"SystemCPUTime\":0.5,\"ExitCode\":0,\"StartTime\":\"2024-01-02T09:00:00Z\"," +
+				"\"WallTime\":3600,\"Energy\":100,\"Host\":\"node1\"}\n",
+			records: []LogRecord{{
+				Timestamp:      time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC),
+				CPU:            "Test CPU",
+				Tag:            "a",
+				UserCPUTime:    1500 * time.Millisecond,
+				SystemCPUTime:  500 * time.Millisecond,
+				StartTime:      time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC),
+				WallTime:       time.Hour,
+				EnergyMeasured: true,
+				Energy:         100,
+				Host:           "node1",
+			}},
+		},
+	}
+	for _, test := range tests {
+		records, err := ReadLog(strings.NewReader(test.log))
+		if err != nil {
+			t.Errorf("%s: ReadLog: %v", test.name, err)
+			continue
+		}
+		if len(records) != len(test.records) || (len(records) > 0 && !reflect.DeepEqual(records, test.records)) {
+			t.Errorf("%s: got records %+v, want %+v", test.name, records, test.records)
+		}
+	}
+}
+
+func TestReadLogUnsupportedSchema(t *testing.T) {
+	logs := map[string]string{
+		"CSV":        "# calcium log schema 99\nTimestamp,CPU,Tag,UserCPUTime,SystemCPUTime\n",
+		"JSON Lines": "{\"Schema\":99,\"CPU\":\"Test CPU\",\"Tag\":\"a\"}\n",
+	}
+	for name, log := range logs {
+		if _, err := ReadLog(strings.NewReader(log)); err == nil {
+			t.Errorf("%s: got no error for a too new schema", name)
+		}
+	}
+}
+
+func TestReadCSVLogSchemaVersion(t *testing.T) {
+	tests := map[string]int{
+		"": 0,
+		"2024-01-02 10:00:00,\"Test CPU\",a,1.00,0.00\n":                                        1,
+		"# calcium log schema 2\nTimestamp\n":                                                   2,
+		"2024-01-02 10:00:00,\"Test CPU\",a,1.00,0.00\n# calcium log schema 5\nTimestamp\n":     5,
+		"# calcium log schema 4\nTimestamp\n# calcium log schema 5\nTimestamp\n2024-01-02,,,\n": 5,
+	}
+	for log, want := range tests {
+		version, err := readCSVLogSchemaVersion(strings.NewReader(log))
+		if err != nil {
+			t.Errorf("readCSVLogSchemaVersion(%q): %v", log, err)
+			continue
+		}
+		if version != want {
+			t.Errorf("readCSVLogSchemaVersion(%q) = %d, want %d", log, version, want)
+		}
+	}
+}
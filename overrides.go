@@ -0,0 +1,238 @@
+package calcium
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// SourceOverride marks TDP info from the user overrides
+const SourceOverride = "override"
+
+// TDPOverride sets the TDP per core of the matching CPUs.
+// Exactly one of CPU, Glob and Regex is set. CPU matches the same CPU model,
+// and Glob and Regex match either the CPU string or its canonical model identifier.
+type TDPOverride struct {
+	CPU   string  `toml:"cpu,omitempty"`   // CPU string of the same model, see SameCPUModel
+	Glob  string  `toml:"glob,omitempty"`  // Glob pattern of the CPU string
+	Regex string  `toml:"regex,omitempty"` // Regular expression of the CPU string
+	Host  string  `toml:"host,omitempty"`  // Glob pattern of the hostname, any host if empty
+	Watts float64 `toml:"watts"`           // [W] per core
+
+	regex *regexp.Regexp // Compiled Regex
+}
+
+type TDPOverrides struct {
+	Overrides []TDPOverride `toml:"override"`
+}
+
+// matchCPU returns the specificity of the CPU string match,
+// or zero if it does not match.
+func (o TDPOverride) matchCPU(cpuString string) (int, error) {
+	cpuStrings := []string{cpuString, NormalizeCPUString(cpuString)}
+	switch {
+	case o.CPU != "":
+		if SameCPUModel(o.CPU, cpuString) {
+			return 3, nil
+		}
+	case o.Glob != "":
+		for _, s := range cpuStrings {
+			ok, err := path.Match(o.Glob, s)
+			if err != nil {
+				return 0, fmt.Errorf("match glob %q: %w", o.Glob, err)
+			}
+			if ok {
+				return 2, nil
+			}
+		}
+	case o.Regex != "":
+		re := o.regex
+		if re == nil {
+			var err error
+			re, err = regexp.Compile(o.Regex)
+			if err != nil {
+				return 0, fmt.Errorf("compile regex %q: %w", o.Regex, err)
+			}
+		}
+		for _, s := range cpuStrings {
+			if re.MatchString(s) {
+				return 1, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+func (o TDPOverride) matchHost(hostname string) (bool, error) {
+	if o.Host == "" {
+		return true, nil
+	}
+	shortHostname, _, _ := strings.Cut(hostname, ".")
+	for _, name := range []string{hostname, shortHostname} {
+		ok, err := path.Match(o.Host, name)
+		if err != nil {
+			return false, fmt.Errorf("match host %q: %w", o.Host, err)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sameKey tells whether the overrides apply to the same CPUs and hosts
+func (o TDPOverride) sameKey(other TDPOverride) bool {
+	return (o.CPU == other.CPU || (o.CPU != "" && other.CPU != "" && SameCPUModel(o.CPU, other.CPU))) &&
+		o.Glob == other.Glob && o.Regex == other.Regex && o.Host == other.Host
+}
+
+// Lookup finds the most specific override for the CPU on the host.
+// Host-specific overrides take precedence, then exact CPU strings,
+// glob and regex patterns. Among equally specific overrides the first one wins.
+func (o *TDPOverrides) Lookup(cpuString, hostname string) (*TDPOverride, error) {
+	var found *TDPOverride
+	bestScore := 0
+	for i, override := range o.Overrides {
+		score, err := override.matchCPU(cpuString)
+		if err != nil {
+			return nil, err
+		}
+		if score == 0 {
+			continue
+		}
+		hostMatches, err := override.matchHost(hostname)
+		if err != nil {
+			return nil, err
+		}
+		if !hostMatches {
+			continue
+		}
+		if override.Host != "" {
+			score += 3
+		}
+		if score > bestScore {
+			found = &o.Overrides[i]
+			bestScore = score
+		}
+	}
+	return found, nil
+}
+
+// compile compiles the regular expressions of the overrides
+func (o *TDPOverrides) compile() error {
+	for i := range o.Overrides {
+		if o.Overrides[i].Regex == "" {
+			continue
+		}
+		re, err := regexp.Compile(o.Overrides[i].Regex)
+		if err != nil {
+			return fmt.Errorf("compile regex %q: %w", o.Overrides[i].Regex, err)
+		}
+		o.Overrides[i].regex = re
+	}
+	return nil
+}
+
+// TDPInfo returns the TDP info from the most specific override
+// for the CPU on the host.
+func (o *TDPOverrides) TDPInfo(cpuString, hostname string) (*TDPInfo, bool, error) {
+	override, err := o.Lookup(cpuString, hostname)
+	if err != nil {
+		return nil, false, fmt.Errorf("lookup overrides: %w", err)
+	}
+	if override == nil {
+		return nil, false, nil
+	}
+	return &TDPInfo{
+		CPUString: cpuString,
+		Watts:     override.Watts,
+		Source:    SourceOverride,
+	}, true, nil
+}
+
+// Set adds the override, replacing the one for the same CPUs and hosts
+func (o *TDPOverrides) Set(override TDPOverride) {
+	for i := range o.Overrides {
+		if o.Overrides[i].sameKey(override) {
+			o.Overrides[i] = override
+			return
+		}
+	}
+	o.Overrides = append(o.Overrides, override)
+}
+
+// Unset removes the override for the same CPUs and hosts
+func (o *TDPOverrides) Unset(override TDPOverride) bool {
+	for i := range o.Overrides {
+		if o.Overrides[i].sameKey(override) {
+			o.Overrides = append(o.Overrides[:i], o.Overrides[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func tdpOverridesFilename() (string, error) {
+	calciumDir, err := getCalciumDir()
+	if err != nil {
+		return "", fmt.Errorf("get calcium directory: %w", err)
+	}
+	return filepath.Join(calciumDir, "tdp-overrides.toml"), nil
+}
+
+// ReadTDPOverrides reads the user overrides from the calcium directory
+func ReadTDPOverrides() (*TDPOverrides, error) {
+	filename, err := tdpOverridesFilename()
+	if err != nil {
+		return nil, err
+	}
+	overrides := &TDPOverrides{}
+	if _, err := toml.DecodeFile(filename, overrides); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return overrides, nil
+		}
+		return nil, fmt.Errorf("decode overrides: %w", err)
+	}
+	if err := overrides.compile(); err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// WriteTDPOverrides writes the user overrides to the calcium directory
+func WriteTDPOverrides(overrides *TDPOverrides) error {
+	filename, err := tdpOverridesFilename()
+	if err != nil {
+		return err
+	}
+	overridesFile, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("create overrides file: %w", err)
+	}
+	defer overridesFile.Close()
+
+	if err := toml.NewEncoder(overridesFile).Encode(overrides); err != nil {
+		return fmt.Errorf("encode overrides: %w", err)
+	}
+	return overridesFile.Close()
+}
+
+// GetTDPInfoOverride returns the TDP info from the user overrides
+// for the CPU on this host.
+func GetTDPInfoOverride(cpuString string) (*TDPInfo, bool, error) {
+	overrides, err := ReadTDPOverrides()
+	if err != nil {
+		return nil, false, fmt.Errorf("read overrides: %w", err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, false, fmt.Errorf("get hostname: %w", err)
+	}
+	return overrides.TDPInfo(cpuString, hostname)
+}
@@ -0,0 +1,161 @@
+package calcium
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPowercapRoot is the sysfs directory of the Linux power capping framework
+const DefaultPowercapRoot = "/sys/class/powercap"
+
+// RAPLZone is a snapshot of the energy counter of a RAPL package zone
+type RAPLZone struct {
+	Name             string
+	EnergyUJ         uint64 // [µJ]
+	MaxEnergyRangeUJ uint64 // [µJ]
+}
+
+func readUintFile(filename string) (uint64, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// ReadRAPLZones reads the energy counters of all RAPL package zones
+// under the powercap root, keyed by the zone directory name.
+func ReadRAPLZones(root string) (map[string]RAPLZone, error) {
+	dirs, err := filepath.Glob(filepath.Join(root, "intel-rapl:*"))
+	if err != nil {
+		return nil, err
+	}
+	zones := map[string]RAPLZone{}
+	for _, dir := range dirs {
+		zoneID := filepath.Base(dir)
+		// Subzones (core, uncore, dram) are already included in the package zone
+		if strings.Count(zoneID, ":") != 1 {
+			continue
+		}
+		name, err := os.ReadFile(filepath.Join(dir, "name"))
+		if err != nil {
+			return nil, fmt.Errorf("read zone name: %w", err)
+		}
+		zoneName := strings.TrimSpace(string(name))
+		if !strings.HasPrefix(zoneName, "package") {
+			continue
+		}
+		energy, err := readUintFile(filepath.Join(dir, "energy_uj"))
+		if err != nil {
+			return nil, fmt.Errorf("read zone energy: %w", err)
+		}
+		maxEnergyRange, err := readUintFile(filepath.Join(dir, "max_energy_range_uj"))
+		if err != nil {
+			return nil, fmt.Errorf("read zone energy range: %w", err)
+		}
+		zones[zoneID] = RAPLZone{
+			Name:             zoneName,
+			EnergyUJ:         energy,
+			MaxEnergyRangeUJ: maxEnergyRange,
+		}
+	}
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("no RAPL package zones found")
+	}
+	return zones, nil
+}
+
+// RAPLEnergy returns the energy [J] consumed by all the package zones
+// between two snapshots, taking the counter wraparound into account.
+func RAPLEnergy(before, after map[string]RAPLZone) (float64, error) {
+	energy := uint64(0)
+	for zoneID, zoneBefore := range before {
+		zoneAfter, ok := after[zoneID]
+		if !ok {
+			return 0, fmt.Errorf("zone %s disappeared", zoneID)
+		}
+		if zoneAfter.EnergyUJ >= zoneBefore.EnergyUJ {
+			energy += zoneAfter.EnergyUJ - zoneBefore.EnergyUJ
+		} else {
+			energy += zoneBefore.MaxEnergyRangeUJ - zoneBefore.EnergyUJ + zoneAfter.EnergyUJ
+		}
+	}
+	return float64(energy) * 1e-6, nil
+}
+
+// raplSamplePeriod is the period of reading the RAPL counters during the run.
+// It has to be shorter than the wrap time of the counters, which is minutes
+// for the usual energy range of 262 kJ at a few hundred watts.
+const raplSamplePeriod = 10 * time.Second
+
+// RAPLMeter accumulates the energy consumed by the package zones
+// by reading the counters periodically, so that wraparounds are not missed
+type RAPLMeter struct {
+	root   string
+	last   map[string]RAPLZone
+	energy float64 // [J]
+	err    error
+	stop   chan bool
+	done   chan bool
+}
+
+// StartRAPLMeter starts measuring the energy of the RAPL package zones under the powercap root
+func StartRAPLMeter(root string) (*RAPLMeter, error) {
+	zones, err := ReadRAPLZones(root)
+	if err != nil {
+		return nil, err
+	}
+	m := &RAPLMeter{
+		root: root,
+		last: zones,
+		stop: make(chan bool),
+		done: make(chan bool),
+	}
+	go func() {
+		ticker := time.NewTicker(raplSamplePeriod)
+		defer ticker.Stop()
+		defer close(m.done)
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.sample(); err != nil {
+					return
+				}
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+	return m, nil
+}
+
+func (m *RAPLMeter) sample() error {
+	zones, err := ReadRAPLZones(m.root)
+	if err == nil {
+		var energy float64
+		energy, err = RAPLEnergy(m.last, zones)
+		m.energy += energy
+		m.last = zones
+	}
+	if err != nil {
+		m.err = err
+	}
+	return err
+}
+
+// Stop stops the measurement and returns the energy [J] consumed since the start
+func (m *RAPLMeter) Stop() (float64, error) {
+	close(m.stop)
+	<-m.done
+	if m.err != nil {
+		return 0, m.err
+	}
+	if err := m.sample(); err != nil {
+		return 0, err
+	}
+	return m.energy, nil
+}
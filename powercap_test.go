@@ -0,0 +1,113 @@
+package calcium
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// writeRAPLZone writes the files of a powercap zone under the root
+func writeRAPLZone(t *testing.T, root, zoneID, name string, energy, maxEnergyRange uint64) {
+	t.Helper()
+	dir := filepath.Join(root, zoneID)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"name":                name + "\n",
+		"energy_uj":           strconv.FormatUint(energy, 10) + "\n",
+		"max_energy_range_uj": strconv.FormatUint(maxEnergyRange, 10) + "\n",
+	}
+	for filename, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, filename), []byte(content), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadRAPLZones(t *testing.T) {
+	root := t.TempDir()
+	writeRAPLZone(t, root, "intel-rapl:0", "package-0", 1000, 1<<32)
+	writeRAPLZone(t, root, "intel-rapl:1", "package-1", 2000, 1<<32)
+	writeRAPLZone(t, root, "intel-rapl:0:0", "core", 500, 1<<32)
+	writeRAPLZone(t, root, "intel-rapl:0:1", "dram", 300, 1<<32)
+	writeRAPLZone(t, root, "intel-rapl:2", "psys", 9000, 1<<32)
+
+	zones, err := ReadRAPLZones(root)
+	if err != nil {
+		t.Fatalf("ReadRAPLZones: %v", err)
+	}
+	want := map[string]RAPLZone{
+		"intel-rapl:0": {Name: "package-0", EnergyUJ: 1000, MaxEnergyRangeUJ: 1 << 32},
+		"intel-rapl:1": {Name: "package-1", EnergyUJ: 2000, MaxEnergyRangeUJ: 1 << 32},
+	}
+	if len(zones) != len(want) {
+		t.Errorf("got zones %v, want %v", zones, want)
+	}
+	for zoneID, zone := range want {
+		if zones[zoneID] != zone {
+			t.Errorf("zone %s: got %+v, want %+v", zoneID, zones[zoneID], zone)
+		}
+	}
+
+	if _, err := ReadRAPLZones(t.TempDir()); err == nil {
+		t.Errorf("got no error for a root without package zones")
+	}
+}
+
+func TestRAPLEnergy(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after uint64
+		want          float64 // [J]
+	}{
+		{"increase", 1_000_000, 3_500_000, 2.5},
+		{"wraparound", 9_000_000, 1_000_000, 2},
+		{"no change", 5_000_000, 5_000_000, 0},
+	}
+	for _, test := range tests {
+		before := map[string]RAPLZone{"intel-rapl:0": {EnergyUJ: test.before, MaxEnergyRangeUJ: 10_000_000}}
+		after := map[string]RAPLZone{"intel-rapl:0": {EnergyUJ: test.after, MaxEnergyRangeUJ: 10_000_000}}
+		energy, err := RAPLEnergy(before, after)
+		if err != nil {
+			t.Fatalf("%s: RAPLEnergy: %v", test.name, err)
+		}
+		if !almostEqual(energy, test.want) {
+			t.Errorf("%s: got %v J, want %v J", test.name, energy, test.want)
+		}
+	}
+
+	before := map[string]RAPLZone{"intel-rapl:0": {}, "intel-rapl:1": {}}
+	after := map[string]RAPLZone{"intel-rapl:0": {}}
+	if _, err := RAPLEnergy(before, after); err == nil {
+		t.Errorf("got no error for a disappeared zone")
+	}
+}
+
+func TestRAPLMeter(t *testing.T) {
+	root := t.TempDir()
+	const maxEnergyRange = 10_000_000
+	writeRAPLZone(t, root, "intel-rapl:0", "package-0", 9_000_000, maxEnergyRange)
+
+	meter, err := StartRAPLMeter(root)
+	if err != nil {
+		t.Fatalf("StartRAPLMeter: %v", err)
+	}
+	// The counter wraps around twice, which only the samples in between catch
+	for _, energy := range []uint64{1_000_000, 9_500_000} {
+		writeRAPLZone(t, root, "intel-rapl:0", "package-0", energy, maxEnergyRange)
+		if err := meter.sample(); err != nil {
+			t.Fatalf("sample: %v", err)
+		}
+	}
+	writeRAPLZone(t, root, "intel-rapl:0", "package-0", 500_000, maxEnergyRange)
+	energy, err := meter.Stop()
+	if err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	// 2 J to the first wraparound, 8.5 J, and 1 J to the second one
+	if want := 11.5; !almostEqual(energy, want) {
+		t.Errorf("got %v J, want %v J", energy, want)
+	}
+}
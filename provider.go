@@ -0,0 +1,242 @@
+package calcium
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/unkaktus/calcium/data"
+)
+
+// ErrTDPNotFound is returned by TDP providers for CPUs they do not know
+var ErrTDPNotFound = errors.New("TDP not found")
+
+// TDPProvider looks up the TDP info of a CPU by its CPUID string.
+// It returns ErrTDPNotFound if the CPU is unknown to it.
+type TDPProvider interface {
+	Lookup(ctx context.Context, cpuString string) (*TDPInfo, error)
+}
+
+// TDPProviderFunc is an adapter to use ordinary functions as TDP providers
+type TDPProviderFunc func(ctx context.Context, cpuString string) (*TDPInfo, error)
+
+func (f TDPProviderFunc) Lookup(ctx context.Context, cpuString string) (*TDPInfo, error) {
+	return f(ctx, cpuString)
+}
+
+// WarningProvider is implemented by the TDP providers
+// that have warnings on their data to be listed in the report
+type WarningProvider interface {
+	Warnings() []string
+}
+
+func providerWarnings(provider TDPProvider) []string {
+	if warningProvider, ok := provider.(WarningProvider); ok {
+		return warningProvider.Warnings()
+	}
+	return nil
+}
+
+// ChainProvider tries the providers in order until one knows the CPU
+type ChainProvider []TDPProvider
+
+func (c ChainProvider) Warnings() []string {
+	warnings := []string{}
+	for _, provider := range c {
+		warnings = append(warnings, providerWarnings(provider)...)
+	}
+	return warnings
+}
+
+func (c ChainProvider) Lookup(ctx context.Context, cpuString string) (*TDPInfo, error) {
+	for _, provider := range c {
+		tdpInfo, err := provider.Lookup(ctx, cpuString)
+		if errors.Is(err, ErrTDPNotFound) {
+			continue
+		}
+		return tdpInfo, err
+	}
+	return nil, ErrTDPNotFound
+}
+
+type hostContextKey struct{}
+
+// WithHost returns the context for the TDP lookup of the CPU of the host,
+// which selects the host-specific overrides
+func WithHost(ctx context.Context, hostname string) context.Context {
+	return context.WithValue(ctx, hostContextKey{}, hostname)
+}
+
+// hostFromContext returns the hostname set by WithHost, empty if not set
+func hostFromContext(ctx context.Context) string {
+	hostname, _ := ctx.Value(hostContextKey{}).(string)
+	return hostname
+}
+
+// OverrideProvider looks up the user overrides in the calcium directory,
+// which are read once on the first lookup. Host-specific overrides
+// are matched against the host set in the context with WithHost.
+type OverrideProvider struct {
+	once      sync.Once
+	overrides *TDPOverrides
+	err       error
+}
+
+func (p *OverrideProvider) Lookup(ctx context.Context, cpuString string) (*TDPInfo, error) {
+	p.once.Do(func() {
+		p.overrides, p.err = ReadTDPOverrides()
+	})
+	if p.err != nil {
+		return nil, fmt.Errorf("read overrides: %w", p.err)
+	}
+	tdpInfo, ok, err := p.overrides.TDPInfo(cpuString, hostFromContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("get override: %w", err)
+	}
+	if !ok {
+		return nil, ErrTDPNotFound
+	}
+	return tdpInfo, nil
+}
+
+// BundledProvider looks up the database bundled with calcium
+type BundledProvider struct{}
+
+func (BundledProvider) Lookup(ctx context.Context, cpuString string) (*TDPInfo, error) {
+	tdpInfo, ok := GetTDPInfoBundled(cpuString)
+	if !ok {
+		return nil, ErrTDPNotFound
+	}
+	return tdpInfo, nil
+}
+
+// CacheProvider looks up the TDP cache in the calcium directory.
+// The malformed rows of the cache are its warnings.
+type CacheProvider struct {
+	mu        sync.Mutex
+	malformed []error
+}
+
+func (p *CacheProvider) Lookup(ctx context.Context, cpuString string) (*TDPInfo, error) {
+	cache, err := ReadTDPCache()
+	if err != nil {
+		return nil, fmt.Errorf("read cache: %w", err)
+	}
+	p.mu.Lock()
+	p.malformed = cache.Malformed
+	p.mu.Unlock()
+	tdpInfo, ok := cache.Get(cpuString)
+	if !ok {
+		return nil, ErrTDPNotFound
+	}
+	return tdpInfo, nil
+}
+
+func (p *CacheProvider) Warnings() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	warnings := []string{}
+	for _, err := range p.malformed {
+		warnings = append(warnings, fmt.Sprintf("skipped malformed TDP cache row: %v", err))
+	}
+	return warnings
+}
+
+// WebProvider looks up the CPU spec pages on the vendor websites
+// using the client, or DefaultHTTPClient if it is nil
+type WebProvider struct {
+	Client *HTTPClient
+}
+
+func (w WebProvider) Lookup(ctx context.Context, cpuString string) (*TDPInfo, error) {
+	return GetTDPInfo(ctx, w.Client, cpuString)
+}
+
+// CachingProvider adds the TDP info found by the provider to the TDP cache
+type CachingProvider struct {
+	Provider TDPProvider
+}
+
+func (c CachingProvider) Lookup(ctx context.Context, cpuString string) (*TDPInfo, error) {
+	tdpInfo, err := c.Provider.Lookup(ctx, cpuString)
+	if err != nil {
+		return nil, err
+	}
+	if err := AppendTDPCache(*tdpInfo); err != nil {
+		return nil, fmt.Errorf("write TDP cache: %w", err)
+	}
+	return tdpInfo, nil
+}
+
+func (c CachingProvider) Warnings() []string {
+	return providerWarnings(c.Provider)
+}
+
+// DefaultMatchConfidence is the minimum confidence of the fuzzy match of CPU strings
+const DefaultMatchConfidence = 0.8
+
+// FuzzyProvider falls back to the closest CPU in the bundled database
+// or the local cache if the provider does not know the CPU.
+// Other errors of the provider are returned as they are.
+type FuzzyProvider struct {
+	Provider      TDPProvider
+	MinConfidence float64
+}
+
+func (f FuzzyProvider) Warnings() []string {
+	return providerWarnings(f.Provider)
+}
+
+func (f FuzzyProvider) Lookup(ctx context.Context, cpuString string) (*TDPInfo, error) {
+	tdpInfo, lookupErr := f.Provider.Lookup(ctx, cpuString)
+	if !errors.Is(lookupErr, ErrTDPNotFound) {
+		return tdpInfo, lookupErr
+	}
+
+	candidates := []string{}
+	for bundledCPUString := range data.TDPs {
+		candidates = append(candidates, bundledCPUString)
+	}
+	cache, err := ReadTDPCache()
+	if err != nil {
+		return nil, fmt.Errorf("read cache: %w", err)
+	}
+	for _, cached := range cache.Entries {
+		candidates = append(candidates, cached.CPUString)
+	}
+	slices.Sort(candidates)
+
+	matched, confidence := FuzzyMatchCPU(cpuString, candidates)
+	if confidence < f.MinConfidence {
+		return nil, lookupErr
+	}
+	tdpInfo, ok := GetTDPInfoBundled(matched)
+	if !ok {
+		tdpInfo, _ = cache.Get(matched)
+	}
+	matchedTDPInfo := *tdpInfo
+	matchedTDPInfo.CPUString = cpuString
+	matchedTDPInfo.MatchedCPUString = matched
+	matchedTDPInfo.MatchConfidence = confidence
+	return &matchedTDPInfo, nil
+}
+
+// DefaultTDPProvider returns the chain of the user overrides, the bundled database,
+// the local cache and, unless offline, the vendor websites with caching,
+// falling back to the closest known CPU.
+func DefaultTDPProvider(offline bool) TDPProvider {
+	chain := ChainProvider{
+		&OverrideProvider{},
+		BundledProvider{},
+		&CacheProvider{},
+	}
+	if !offline {
+		chain = append(chain, CachingProvider{Provider: WebProvider{}})
+	}
+	return FuzzyProvider{
+		Provider:      chain,
+		MinConfidence: DefaultMatchConfidence,
+	}
+}
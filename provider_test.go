@@ -0,0 +1,38 @@
+package calcium
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFuzzyProvider(t *testing.T) {
+	// The fuzzy fallback reads the TDP cache in the calcium directory
+	t.Setenv("HOME", t.TempDir())
+
+	errNetwork := errors.New("network is unreachable")
+	provider := FuzzyProvider{
+		Provider: TDPProviderFunc(func(ctx context.Context, cpuString string) (*TDPInfo, error) {
+			if cpuString == "Intel Zeon Platinum 8470" {
+				return nil, errNetwork
+			}
+			return nil, ErrTDPNotFound
+		}),
+		MinConfidence: DefaultMatchConfidence,
+	}
+
+	tdpInfo, err := provider.Lookup(context.Background(), "Intel Zeon Platinum 8468")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if tdpInfo.MatchedCPUString != "Intel(R) Xeon(R) Platinum 8468" || tdpInfo.CPUString != "Intel Zeon Platinum 8468" {
+		t.Errorf("got TDP info %+v, want the one of Intel(R) Xeon(R) Platinum 8468", tdpInfo)
+	}
+
+	if _, err := provider.Lookup(context.Background(), "Intel Zeon Platinum 8470"); !errors.Is(err, errNetwork) {
+		t.Errorf("got error %v, want %v", err, errNetwork)
+	}
+	if _, err := provider.Lookup(context.Background(), "Intel(R) Xeon(R) Platinum 8468V"); !errors.Is(err, ErrTDPNotFound) {
+		t.Errorf("got error %v, want %v", err, ErrTDPNotFound)
+	}
+}
@@ -0,0 +1,178 @@
+package calcium
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/unkaktus/calcium/data"
+)
+
+// maxRegionSuggestions limits the close matches suggested for unknown regions
+const maxRegionSuggestions = 3
+
+// UnknownRegionError is returned for regions not in the carbon intensity data
+type UnknownRegionError struct {
+	Region      string
+	Suggestions []string // Close matches of the region codes
+}
+
+func (e *UnknownRegionError) Error() string {
+	if len(e.Suggestions) == 0 {
+		return fmt.Sprintf("unknown region %q", e.Region)
+	}
+	return fmt.Sprintf("unknown region %q, did you mean %s?", e.Region, strings.Join(e.Suggestions, ", "))
+}
+
+// suggestRegions returns the codes of the regions whose codes or names
+// contain the region, or are the closest to it by edit distance
+func suggestRegions(dataset *data.CarbonIntensityDataset, region string) []string {
+	region = strings.ToLower(region)
+	type candidate struct {
+		code     string
+		distance int
+	}
+	candidates := []candidate{}
+	for code, name := range dataset.Names {
+		lowerCode, lowerName := strings.ToLower(code), strings.ToLower(name)
+		distance := 0
+		if !strings.Contains(lowerName, region) && !strings.Contains(lowerCode, region) {
+			distance = min(
+				levenshtein([]rune(region), []rune(lowerCode)),
+				levenshtein([]rune(region), []rune(lowerName)),
+			)
+		}
+		// Skip the matches that have little in common
+		if distance > max(2, len(region)/3) {
+			continue
+		}
+		candidates = append(candidates, candidate{code: code, distance: distance})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].code < candidates[j].code
+	})
+	suggestions := []string{}
+	for i := 0; i < len(candidates) && i < maxRegionSuggestions; i++ {
+		suggestions = append(suggestions, candidates[i].code)
+	}
+	return suggestions
+}
+
+// countryCode returns the alpha-3 code of the country given by its alpha-2 or alpha-3 code
+func countryCode(code string) (string, bool) {
+	if alpha3, ok := data.RegionAlpha2[code]; ok {
+		return alpha3, true
+	}
+	for _, alpha3 := range data.RegionAlpha2 {
+		if alpha3 == code {
+			return alpha3, true
+		}
+	}
+	return "", false
+}
+
+// resolveRegion returns the region code, and whether the region is an unknown
+// subregion that fell back to its country
+func resolveRegion(dataset *data.CarbonIntensityDataset, region string) (string, bool, error) {
+	if _, ok := dataset.Series[region]; ok {
+		return region, false, nil
+	}
+	upperRegion := strings.ToUpper(region)
+	if _, ok := dataset.Series[upperRegion]; ok {
+		return upperRegion, false, nil
+	}
+	if code, ok := data.RegionAlpha2[upperRegion]; ok {
+		if _, ok := dataset.Series[code]; ok {
+			return code, false, nil
+		}
+	}
+	for code, name := range dataset.Names {
+		if strings.EqualFold(name, region) {
+			return code, false, nil
+		}
+	}
+	// Subregions are also accepted with the alpha-2 country code, e.g., CA-QC,
+	// and unknown subregions of known countries fall back to the country.
+	// Other names with the separator, e.g., Guinea-Bissau, are not split.
+	if country, subregion, ok := strings.Cut(upperRegion, data.SubregionSeparator); ok {
+		if code, ok := countryCode(country); ok {
+			if _, ok := dataset.Series[code+data.SubregionSeparator+subregion]; ok {
+				return code + data.SubregionSeparator + subregion, false, nil
+			}
+			if _, ok := dataset.Series[code]; ok {
+				return code, true, nil
+			}
+		}
+	}
+	return "", false, &UnknownRegionError{
+		Region:      region,
+		Suggestions: suggestRegions(dataset, region),
+	}
+}
+
+// ResolveRegion returns the region code of the region given by its code,
+// ISO 3166-1 alpha-2 code or name, all case-insensitive. Subnational grid regions
+// are given by the country and the subregion codes, e.g., USA-ERCT or CAN-QC,
+// and unknown subregions of known countries fall back to the country.
+// Unknown regions fail with UnknownRegionError.
+func ResolveRegion(region string) (string, error) {
+	dataset, err := DefaultCarbonIntensityData()
+	if err != nil {
+		return "", err
+	}
+	code, _, err := resolveRegion(dataset, region)
+	return code, err
+}
+
+// RegionInfo describes the carbon intensity data of the region
+type RegionInfo struct {
+	Code            string
+	Name            string
+	Year            int
+	CarbonIntensity float64 // [gCO2e/kWh]
+}
+
+// ListRegions lists the regions whose codes, ISO 3166-1 alpha-2 codes or names
+// contain the search string case-insensitively, all of them if it is empty.
+// The carbon intensity is of the year, or of the latest year if it is zero.
+func ListRegions(search string, year int) ([]RegionInfo, error) {
+	dataset, err := DefaultCarbonIntensityData()
+	if err != nil {
+		return nil, err
+	}
+	alpha2Codes := map[string]string{}
+	for alpha2, code := range data.RegionAlpha2 {
+		alpha2Codes[code] = alpha2
+	}
+
+	search = strings.ToLower(search)
+	regions := []RegionInfo{}
+	for code, name := range dataset.Names {
+		if search != "" &&
+			!strings.Contains(strings.ToLower(code), search) &&
+			!strings.Contains(strings.ToLower(name), search) &&
+			strings.ToLower(alpha2Codes[code]) != search {
+			continue
+		}
+		carbonIntensity, err := carbonIntensityRegion(dataset, code)
+		if year != 0 {
+			carbonIntensity, err = carbonIntensityRegionYear(dataset, code, year)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get carbon intensity of %s: %w", code, err)
+		}
+		regions = append(regions, RegionInfo{
+			Code:            code,
+			Name:            name,
+			Year:            carbonIntensity.Year,
+			CarbonIntensity: carbonIntensity.Value,
+		})
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		return regions[i].Code < regions[j].Code
+	})
+	return regions, nil
+}
@@ -0,0 +1,48 @@
+package calcium
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/unkaktus/calcium/data"
+)
+
+func TestResolveRegion(t *testing.T) {
+	tests := []struct {
+		region   string
+		code     string
+		fellBack bool
+	}{
+		{"DEU", "DEU", false},
+		{"de", "DEU", false},
+		{"germany", "DEU", false},
+		// Names with the separator are not subregions
+		{"Guinea-Bissau", "GNB", false},
+		{"USA-ERCT", "USA-ERCT", false},
+		{"usa-erct", "USA-ERCT", false},
+		{"CA-QC", "CAN-QC", false},
+		{"IND-ALL", "IND-ALL", false},
+		// Unknown subregions of known countries
+		{"USA-XXXX", "USA", true},
+		{"CA-XX", "CAN", true},
+	}
+	for _, test := range tests {
+		code, fellBack, err := resolveRegion(data.EmbeddedCarbonIntensityData, test.region)
+		if err != nil {
+			t.Errorf("resolveRegion(%q): %v", test.region, err)
+			continue
+		}
+		if code != test.code || fellBack != test.fellBack {
+			t.Errorf("resolveRegion(%q) = %q, %v, want %q, %v", test.region, code, fellBack, test.code, test.fellBack)
+		}
+	}
+
+	// Misspelled names do not fall back to the prefix
+	for _, region := range []string{"Guinea-Bisau", "XYZ-QC"} {
+		code, _, err := resolveRegion(data.EmbeddedCarbonIntensityData, region)
+		unknownRegionError := &UnknownRegionError{}
+		if !errors.As(err, &unknownRegionError) {
+			t.Errorf("resolveRegion(%q) = %q, %v, want UnknownRegionError", region, code, err)
+		}
+	}
+}
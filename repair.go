@@ -0,0 +1,237 @@
+package calcium
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LogLineError describes a malformed line of the log
+type LogLineError struct {
+	Line     int
+	Text     string
+	Err      error
+	Salvaged bool
+}
+
+func (e LogLineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func parseCSVLine(line string) ([]string, error) {
+	csvReader := csv.NewReader(strings.NewReader(line))
+	csvReader.FieldsPerRecord = -1
+	rows, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) != 1 {
+		return nil, fmt.Errorf("expected a single row")
+	}
+	return rows[0], nil
+}
+
+// salvageCSVLine tries to recover a row written with unescaped
+// CPU or tag strings that contain commas or quotes.
+// The CPU is expected to be quoted, and the tag to be followed only
+// by the numeric fields, so all the possible splits are tried out,
+// preferring the longest CPU string as the tag has not been quoted.
+func salvageCSVLine(layout *csvLogLayout, headerKnown bool, line string) (*LogRecord, error) {
+	fields := strings.Split(line, ",")
+	if len(fields) < len(requiredLogColumns) || !strings.HasPrefix(fields[1], "\"") {
+		return nil, fmt.Errorf("unrecognized row")
+	}
+	for cpuEnd := len(fields) - 1; cpuEnd >= 2; cpuEnd-- {
+		cpu := strings.Join(fields[1:cpuEnd], ",")
+		if len(cpu) < 2 || !strings.HasSuffix(cpu, "\"") {
+			continue
+		}
+		cpu = cpu[1 : len(cpu)-1]
+		for tagEnd := cpuEnd + 1; tagEnd < len(fields); tagEnd++ {
+			tail := fields[tagEnd:]
+			if headerKnown && len(tail) != len(layout.columns)-3 {
+				continue
+			}
+			row := append([]string{fields[0], cpu, strings.Join(fields[cpuEnd:tagEnd], ",")}, tail...)
+			record, err := parseLogRecord(layout.columns, row)
+			if err == nil {
+				return record, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no valid split found")
+}
+
+func repairCSVLog(r io.Reader, w io.Writer) ([]LogLineError, error) {
+	layout := newCSVLogLayout()
+	headerKnown := false
+	records := []LogRecord{}
+	lineErrors := []LogLineError{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		row, err := parseCSVLine(text)
+		if err == nil {
+			var record *LogRecord
+			record, err = layout.parseRow(row)
+			if err == nil {
+				if record != nil {
+					records = append(records, *record)
+				} else if row[0] == logColumns[0] {
+					headerKnown = true
+				}
+				continue
+			}
+		}
+
+		lineError := LogLineError{
+			Line: line,
+			Text: text,
+			Err:  err,
+		}
+		if record, err := salvageCSVLine(layout, headerKnown, text); err == nil {
+			records = append(records, *record)
+			lineError.Salvaged = true
+		}
+		lineErrors = append(lineErrors, lineError)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read log: %w", err)
+	}
+
+	if err := writeCSVLogHeader(w); err != nil {
+		return nil, fmt.Errorf("write header: %w", err)
+	}
+	csvWriter := csv.NewWriter(w)
+	for _, record := range records {
+		csvWriter.Write(logRecordRow(record))
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return nil, fmt.Errorf("write log: %w", err)
+	}
+	return lineErrors, nil
+}
+
+func repairJSONLog(r io.Reader, w io.Writer) ([]LogLineError, error) {
+	lineErrors := []LogLineError{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		record, err := parseJSONLogRecord(scanner.Bytes())
+		if err != nil {
+			lineErrors = append(lineErrors, LogLineError{
+				Line: line,
+				Text: text,
+				Err:  err,
+			})
+			continue
+		}
+		log, err := formatJSONLogRecord(*record)
+		if err != nil {
+			return nil, fmt.Errorf("format log record: %w", err)
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", log); err != nil {
+			return nil, fmt.Errorf("write log: %w", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read log: %w", err)
+	}
+	return lineErrors, nil
+}
+
+// RepairLog reads the log and writes all the valid and salvageable records
+// to w in the same format. CSV logs are rewritten in the current layout.
+// Malformed lines are returned, whether they were salvaged or dropped.
+func RepairLog(r io.Reader, w io.Writer) ([]LogLineError, error) {
+	bufReader := bufio.NewReader(r)
+	// The leading whitespace is only peeked at to keep the line numbers
+	for n := 1; ; n++ {
+		b, err := bufReader.Peek(n)
+		if err == io.EOF && n == 1 {
+			return []LogLineError{}, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, fmt.Errorf("read log: %w", err)
+		}
+		if len(b) < n {
+			return repairCSVLog(bufReader, w)
+		}
+		switch b[n-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '{':
+			return repairJSONLog(bufReader, w)
+		}
+		return repairCSVLog(bufReader, w)
+	}
+}
+
+// RepairLogFile repairs the log file in place,
+// keeping the original file with the .bak suffix.
+func RepairLogFile(filename string) ([]LogLineError, error) {
+	unlock, err := lockFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("lock log file: %w", err)
+	}
+	defer unlock()
+
+	logFile, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open log file: %w", err)
+	}
+	defer logFile.Close()
+
+	logInfo, err := logFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat log file: %w", err)
+	}
+	repairedFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".repair")
+	if err != nil {
+		return nil, fmt.Errorf("create repaired log file: %w", err)
+	}
+	defer os.Remove(repairedFile.Name())
+	defer repairedFile.Close()
+	if err := repairedFile.Chmod(logInfo.Mode()); err != nil {
+		return nil, fmt.Errorf("set repaired log file mode: %w", err)
+	}
+
+	lineErrors, err := RepairLog(logFile, repairedFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(lineErrors) == 0 {
+		return lineErrors, nil
+	}
+	if err := repairedFile.Close(); err != nil {
+		return nil, fmt.Errorf("close repaired log file: %w", err)
+	}
+
+	backupFilename := filename + ".bak"
+	if err := os.Remove(backupFilename); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("remove old backup: %w", err)
+	}
+	if err := os.Link(filename, backupFilename); err != nil {
+		return nil, fmt.Errorf("back up log file: %w", err)
+	}
+	if err := os.Rename(repairedFile.Name(), filename); err != nil {
+		return nil, fmt.Errorf("replace log file: %w", err)
+	}
+	return lineErrors, nil
+}
@@ -0,0 +1,108 @@
+package calcium
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepairLog(t *testing.T) {
+	tests := []struct {
+		name       string
+		log        string
+		tags       []string
+		cpus       []string
+		lineErrors []LogLineError
+	}{
+		{
+			name: "valid",
+			log:  "2024-01-02 10:00:00,\"Test CPU\",a,1.00,0.00\n",
+			tags: []string{"a"},
+			cpus: []string{"Test CPU"},
+		},
+		{
+			name: "tag with a comma",
+			log:  "2024-01-02 10:00:00,\"Test CPU\",run,1,12.50,1.20\n",
+			tags: []string{"run,1"},
+			cpus: []string{"Test CPU"},
+			lineErrors: []LogLineError{
+				{Line: 1, Salvaged: true},
+			},
+		},
+		{
+			name: "CPU with quotes",
+			log:  "2024-01-02 10:00:00,\"Test \"Special\" CPU\",a,1.00,0.00\n",
+			tags: []string{"a"},
+			cpus: []string{"Test \"Special\" CPU"},
+			lineErrors: []LogLineError{
+				{Line: 1, Salvaged: true},
+			},
+		},
+		{
+			name: "unrecoverable line",
+			log:  "\n\n2024-01-02 10:00:00,\"Test CPU\",a,1.00,0.00\ngarbage\n2024-01-02 11:00:00,\"Test CPU\",b,1.00,0.00\n",
+			tags: []string{"a", "b"},
+			cpus: []string{"Test CPU", "Test CPU"},
+			lineErrors: []LogLineError{
+				{Line: 4, Salvaged: false},
+			},
+		},
+		{
+			name: "JSON Lines",
+			log:  "{\"Schema\":5,\"CPU\":\"Test CPU\",\"Tag\":\"a\"}\n{\"Schema\":5,\"CPU\n",
+			tags: []string{"a"},
+			cpus: []string{"Test CPU"},
+			lineErrors: []LogLineError{
+				{Line: 2, Salvaged: false},
+			},
+		},
+	}
+	for _, test := range tests {
+		repaired := &bytes.Buffer{}
+		lineErrors, err := RepairLog(strings.NewReader(test.log), repaired)
+		if err != nil {
+			t.Errorf("%s: RepairLog: %v", test.name, err)
+			continue
+		}
+		if len(lineErrors) != len(test.lineErrors) {
+			t.Errorf("%s: got line errors %v, want %v", test.name, lineErrors, test.lineErrors)
+			continue
+		}
+		for i, lineError := range lineErrors {
+			if lineError.Line != test.lineErrors[i].Line || lineError.Salvaged != test.lineErrors[i].Salvaged {
+				t.Errorf("%s: got line %d salvaged %v, want line %d salvaged %v", test.name,
+					lineError.Line, lineError.Salvaged, test.lineErrors[i].Line, test.lineErrors[i].Salvaged)
+			}
+		}
+
+		// The repaired log is read back as is
+		records, err := ReadLog(repaired)
+		if err != nil {
+			t.Errorf("%s: read repaired log: %v", test.name, err)
+			continue
+		}
+		if len(records) != len(test.tags) {
+			t.Errorf("%s: got %d records, want %d", test.name, len(records), len(test.tags))
+			continue
+		}
+		for i, record := range records {
+			if record.Tag != test.tags[i] || record.CPU != test.cpus[i] {
+				t.Errorf("%s: got tag %q and CPU %q, want %q and %q", test.name, record.Tag, record.CPU, test.tags[i], test.cpus[i])
+			}
+		}
+	}
+
+	// The salvaged row keeps the numeric fields after the tag
+	repaired := &bytes.Buffer{}
+	if _, err := RepairLog(strings.NewReader("2024-01-02 10:00:00,\"Test CPU\",run,1,12.50,1.20\n"), repaired); err != nil {
+		t.Fatalf("RepairLog: %v", err)
+	}
+	records, err := ReadLog(repaired)
+	if err != nil {
+		t.Fatalf("read repaired log: %v", err)
+	}
+	if records[0].UserCPUTime != 12500*time.Millisecond || records[0].SystemCPUTime != 1200*time.Millisecond {
+		t.Errorf("got CPU times %v and %v, want 12.5s and 1.2s", records[0].UserCPUTime, records[0].SystemCPUTime)
+	}
+}
@@ -1,121 +1,400 @@
 package calcium
 
 import (
-	"encoding/csv"
+	"context"
 	"encoding/json"
 	"fmt"
-	"os"
+	"io"
 	"path/filepath"
-	"strconv"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/unkaktus/calcium/data"
 )
 
-// Return regional carbon intesity per unit of energy [gCO2e/kWh]
+// Return regional carbon intesity per unit of energy [gCO2e/kWh].
+// The region is resolved with ResolveRegion.
 func GetCarbonIntensityRegion(region string) (*data.CarbonIntensity, error) {
-	carbonIntensity, ok := data.CarbonIntensities[region]
-	if !ok {
-		return nil, fmt.Errorf("unknown region")
+	dataset, err := DefaultCarbonIntensityData()
+	if err != nil {
+		return nil, err
+	}
+	return carbonIntensityRegion(dataset, region)
+}
+
+// GetCarbonIntensityRegionYear returns the regional carbon intensity in the year.
+// If there is no data for the year, the nearest available year is used,
+// preferring the earlier one if two years are equally near.
+// The region is resolved with ResolveRegion.
+func GetCarbonIntensityRegionYear(region string, year int) (*data.CarbonIntensity, error) {
+	dataset, err := DefaultCarbonIntensityData()
+	if err != nil {
+		return nil, err
+	}
+	return carbonIntensityRegionYear(dataset, region, year)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func carbonIntensityRegion(dataset *data.CarbonIntensityDataset, region string) (*data.CarbonIntensity, error) {
+	code, _, err := resolveRegion(dataset, region)
+	if err != nil {
+		return nil, err
 	}
+	carbonIntensity := dataset.Latest[code]
 	return &carbonIntensity, nil
 }
 
+func carbonIntensityRegionYear(dataset *data.CarbonIntensityDataset, region string, year int) (*data.CarbonIntensity, error) {
+	code, _, err := resolveRegion(dataset, region)
+	if err != nil {
+		return nil, err
+	}
+	series := dataset.Series[code]
+	nearest := series[0]
+	for _, carbonIntensity := range series[1:] {
+		if abs(carbonIntensity.Year-year) < abs(nearest.Year-year) {
+			nearest = carbonIntensity
+		}
+	}
+	return &nearest, nil
+}
+
 type Consumption struct {
-	CPUTime float64 // [h]
-	Energy  float64 // [kWh]
-	CO2e    float64 `json:",omitempty"` // [kg]
+	Runs         int
+	FailedRuns   int     `json:",omitempty"`
+	MeasuredRuns int     `json:",omitempty"`
+	CPUTime      float64 // [h]
+	WallTime     float64 `json:",omitempty"` // [h]
+	MaxMemory    float64 `json:",omitempty"` // [GB]
+	Energy       float64 // [kWh]
+	MemoryEnergy float64 `json:",omitempty"` // [kWh]
+	CO2e         float64 `json:",omitempty"` // [kg]
 }
 
 type Report struct {
-	Timestamp           string
-	Software            string
-	Region              string `json:",omitempty"`
-	CarbonIntensityYear int    `json:",omitempty"`
-	Units               map[string]string
-	Tags                map[string]*Consumption
+	Timestamp string
+	Software  string
+	Region    string `json:",omitempty"`
+	// Source and retrieval date of the carbon intensity dataset
+	CarbonIntensitySource    string `json:",omitempty"`
+	CarbonIntensityRetrieved string `json:",omitempty"`
+	// Year of the carbon intensity data used for the latest run,
+	// which is the only year used if all the runs are of the same year
+	CarbonIntensityYear int `json:",omitempty"`
+	// Carbon intensity used for the runs of each year, which is of
+	// the nearest available year if there is no data for the year
+	CarbonIntensities map[int]*data.CarbonIntensity `json:",omitempty"`
+	Units             map[string]string
+	Tags              map[string]*Consumption
+	CPUs              map[string]*TDPInfo `json:",omitempty"` // TDP info used for the estimates
+	Warnings          []string            `json:",omitempty"`
 }
 
-func MakeReport(logFilename, region string, nodeFactor float64) error {
+func readLogs(logFilename string) ([]LogRecord, error) {
+	logFilenames := []string{logFilename}
 	if logFilename == "" {
-		calciumDir, err := getCalciumDir()
+		filenames, err := DefaultLogFilenames()
 		if err != nil {
-			return fmt.Errorf("get calcium directory: %w", err)
+			return nil, err
 		}
-		logFilename = filepath.Join(calciumDir, "log.csv")
+		logFilenames = filenames
 	}
-	logFile, err := os.OpenFile(logFilename, os.O_RDONLY, 0775)
-	if err != nil {
-		return fmt.Errorf("open report file: %w", err)
+
+	records := []LogRecord{}
+	for _, filename := range logFilenames {
+		logRecords, err := ReadLogFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(filename), err)
+		}
+		records = append(records, logRecords...)
 	}
-	defer logFile.Close()
+	return records, nil
+}
 
-	csvReader := csv.NewReader(logFile)
-	records, err := csvReader.ReadAll()
-	if err != nil {
-		return fmt.Errorf("read log file: %w", err)
+// DefaultNodeFactor is the multiplication factor for the TDP
+// to account for consumption of other node components
+const DefaultNodeFactor = 1.17
+
+// DefaultTDPWatts is the TDP per core [W] used for CPUs with unknown TDP in offline mode
+const DefaultTDPWatts = 10.0
+
+// SourceDefault marks TDP info that fell back to the default value
+const SourceDefault = "default"
+
+// SMTFactorPerThread sets the SMT scaling to the per-thread TDP,
+// which is the default of calcium report
+const SMTFactorPerThread = -1.0
+
+// ReportOptions are the parameters of the report
+type ReportOptions struct {
+	// Region to calculate the carbon intensity, empty to skip CO2e
+	Region string
+	// Multiplication factor for the TDP estimates to account for consumption
+	// of other node components, zero means DefaultNodeFactor.
+	// Measured energy is used as is.
+	NodeFactor float64
+	// Power consumption of resident memory [W/GB], zero disables the memory power model
+	MemoryPower float64
+	// Scaling factor for the TDP per core on hosts with SMT, as CPU time
+	// is accounted per hardware thread. SMTFactorPerThread divides
+	// the TDP per core by the number of threads per core,
+	// and zero or 1 disable the SMT scaling.
+	SMTFactor float64
+
+	// Only include these tags, all the tags if empty
+	Tags []string
+	// Only include runs that ended within [Since, Until), zero times are unbounded
+	Since time.Time
+	Until time.Time
+
+	// Offline forbids network access for TDP lookups. CPUs with unknown TDP
+	// fall back to DefaultWatts and are listed in the report warnings.
+	Offline bool
+	// TDP per core [W] for CPUs with unknown TDP in offline mode, zero means DefaultTDPWatts
+	DefaultWatts float64
+
+	// TDPProvider looks up the TDP info of the CPUs. If nil, BuildReport uses
+	// the bundled database only, and MakeReport uses DefaultTDPProvider
+	// (offline in offline mode), which reads the calcium directory.
+	TDPProvider TDPProvider
+	// CarbonIntensityData is the carbon intensity dataset. If nil, BuildReport
+	// uses the embedded dataset, and MakeReport uses DefaultCarbonIntensityData.
+	CarbonIntensityData *data.CarbonIntensityDataset
+}
+
+func (o ReportOptions) includes(record LogRecord) bool {
+	if len(o.Tags) > 0 && !slices.Contains(o.Tags, record.Tag) {
+		return false
+	}
+	if !o.Since.IsZero() && record.Timestamp.Before(o.Since) {
+		return false
+	}
+	if !o.Until.IsZero() && !record.Timestamp.Before(o.Until) {
+		return false
 	}
+	return true
+}
 
-	report := Report{
+// smtScaling returns the scaling of the TDP per core for the run.
+// Runs in older logs have no threads per core and are not scaled,
+// as SMT could have been disabled on the host.
+func smtScaling(record LogRecord, smtFactor float64) float64 {
+	if record.ThreadsPerCore <= 1 || smtFactor == 0 {
+		return 1
+	}
+	if smtFactor == SMTFactorPerThread {
+		return 1 / float64(record.ThreadsPerCore)
+	}
+	return smtFactor
+}
+
+// BuildReport aggregates the consumption of the log records.
+// It accesses neither the filesystem nor the network by itself,
+// only through the TDP provider given in the options.
+func BuildReport(records []LogRecord, options ReportOptions) (*Report, error) {
+	nodeFactor := options.NodeFactor
+	if nodeFactor == 0 {
+		nodeFactor = DefaultNodeFactor
+	}
+	defaultWatts := options.DefaultWatts
+	if defaultWatts == 0 {
+		defaultWatts = DefaultTDPWatts
+	}
+	tdpProvider := options.TDPProvider
+	if tdpProvider == nil {
+		tdpProvider = BundledProvider{}
+	}
+	// CPUs with warnings on their TDP info
+	warnedCPUs := map[string]bool{}
+	var latestRun time.Time
+
+	report := &Report{
 		Software:  "github.com/unkaktus/calcium",
 		Timestamp: time.Now().Format(time.DateTime),
 		Tags:      map[string]*Consumption{},
+		CPUs:      map[string]*TDPInfo{},
 		Units: map[string]string{
-			"CPUTime": "h",
-			"Energy":  "kWh",
-			"CO2e":    "kg",
+			"CPUTime":      "h",
+			"WallTime":     "h",
+			"MaxMemory":    "GB",
+			"Energy":       "kWh",
+			"MemoryEnergy": "kWh",
+			"CO2e":         "kg",
 		},
 	}
 
-	var carbonIntensity *data.CarbonIntensity
-	if region != "none" {
-		carbonIntensity, err = GetCarbonIntensityRegion(region)
+	carbonIntensityData := options.CarbonIntensityData
+	if carbonIntensityData == nil {
+		carbonIntensityData = data.EmbeddedCarbonIntensityData
+	}
+	if options.Region != "" {
+		region, fellBack, err := resolveRegion(carbonIntensityData, options.Region)
 		if err != nil {
-			return fmt.Errorf("get emissions per energy unit: %w", err)
+			return nil, fmt.Errorf("get emissions per energy unit: %w", err)
+		}
+		if fellBack {
+			report.Warnings = append(report.Warnings,
+				fmt.Sprintf("unknown subregion %q, using the carbon intensity of %s", options.Region, region))
 		}
 		report.Region = region
-		report.CarbonIntensityYear = carbonIntensity.Year
+		report.CarbonIntensities = map[int]*data.CarbonIntensity{}
+		report.CarbonIntensitySource = carbonIntensityData.Source
+		if !carbonIntensityData.RetrievedAt.IsZero() {
+			report.CarbonIntensityRetrieved = carbonIntensityData.RetrievedAt.Format(time.DateOnly)
+		}
+		// The bundled subregions come from their own sources
+		if series, ok := data.SubregionCarbonIntensityData.Series[region]; ok && slices.Equal(series, carbonIntensityData.Series[region]) {
+			report.CarbonIntensitySource = data.SubregionCarbonIntensityData.Source
+			report.CarbonIntensityRetrieved = ""
+		}
 	}
 
-	for _, row := range records {
-		if len(row) < 5 {
-			return fmt.Errorf("invalid row length")
+	for _, record := range records {
+		if !options.includes(record) {
+			continue
 		}
-		tag := row[2]
+		tag := record.Tag
 
 		if _, ok := report.Tags[tag]; !ok {
 			report.Tags[tag] = &Consumption{}
 		}
 
-		// Sum the CPU times up
-		userCPUTime, err := strconv.ParseFloat(row[3], 32)
-		if err != nil {
-			return fmt.Errorf("parse user CPU time: %w", err)
-		}
-		systemCPUTime, err := strconv.ParseFloat(row[4], 32)
-		if err != nil {
-			return fmt.Errorf("parse user CPU time: %w", err)
+		// Count the runs, older logs have no exit status
+		report.Tags[tag].Runs++
+		if record.ExitCode != 0 {
+			report.Tags[tag].FailedRuns++
 		}
-		localCPUTime := (userCPUTime + systemCPUTime) / 3600 // In hours
+
+		// Sum the CPU times up
+		localCPUTime := (record.UserCPUTime + record.SystemCPUTime).Hours()
 		report.Tags[tag].CPUTime += localCPUTime
 
-		// Calculate energy
-		cpuString := row[1]
-		tdpInfo, err := GetTDPInfoCached(cpuString)
-		if err != nil {
-			return fmt.Errorf("get TDP info: %w", err)
+		// Sum the wall times up, older logs have no wall time
+		localWallTime := record.WallTime.Hours()
+		report.Tags[tag].WallTime += localWallTime
+
+		// Find peak memory, older logs have no memory usage
+		localMemory := float64(record.MaxRSS) / 1e9 // In GB
+		report.Tags[tag].MaxMemory = max(report.Tags[tag].MaxMemory, localMemory)
+
+		// Calculate energy, preferring the measured one
+		localEnergy := 0.0
+		if record.EnergyMeasured {
+			localEnergy = record.Energy / 3.6e6 // In kWh
+			report.Tags[tag].MeasuredRuns++
+		} else {
+			tdpInfo, err := tdpProvider.Lookup(WithHost(context.Background(), record.Host), record.CPU)
+			if err != nil {
+				if !options.Offline {
+					return nil, fmt.Errorf("get TDP info: %w", err)
+				}
+				tdpInfo = &TDPInfo{
+					CPUString: record.CPU,
+					Watts:     defaultWatts,
+					Source:    SourceDefault,
+				}
+				if !warnedCPUs[record.CPU] {
+					warnedCPUs[record.CPU] = true
+					report.Warnings = append(report.Warnings,
+						fmt.Sprintf("unknown TDP of %q (%v), using the default of %.2f W per core", record.CPU, err, defaultWatts))
+				}
+			}
+			if tdpInfo.MatchedCPUString != "" && !warnedCPUs[record.CPU] {
+				warnedCPUs[record.CPU] = true
+				report.Warnings = append(report.Warnings,
+					fmt.Sprintf("unknown TDP of %q, using the one of the closest known CPU %q (match confidence %.2f)",
+						record.CPU, tdpInfo.MatchedCPUString, tdpInfo.MatchConfidence))
+			}
+			tdpInfo.Model = record.CPUModel
+			if tdpInfo.Model == "" {
+				tdpInfo.Model = NormalizeCPUString(record.CPU)
+			}
+			report.CPUs[record.CPU] = tdpInfo
+			watts := tdpInfo.Watts * smtScaling(record, options.SMTFactor)
+			localEnergy = localCPUTime * (watts * 1e-3) * nodeFactor
 		}
-		localEnergy := localCPUTime * (tdpInfo.Watts * 1e-3) * nodeFactor
+
+		// Memory energy is accounted for the peak memory over the whole run
+		localMemoryEnergy := localWallTime * (localMemory * options.MemoryPower * 1e-3)
+		report.Tags[tag].MemoryEnergy += localMemoryEnergy
+		localEnergy += localMemoryEnergy
+
 		report.Tags[tag].Energy += localEnergy
 
-		// Calculate CO2e
-		if region != "none" {
+		// Calculate CO2e with the carbon intensity of the year of the run
+		if options.Region != "" {
+			year := record.Timestamp.Year()
+			carbonIntensity, ok := report.CarbonIntensities[year]
+			if !ok {
+				var err error
+				carbonIntensity, err = carbonIntensityRegionYear(carbonIntensityData, report.Region, year)
+				if err != nil {
+					return nil, fmt.Errorf("get emissions per energy unit: %w", err)
+				}
+				report.CarbonIntensities[year] = carbonIntensity
+				// Subregions have data for few years only
+				if carbonIntensity.Year != year && strings.Contains(report.Region, data.SubregionSeparator) {
+					report.Warnings = append(report.Warnings,
+						fmt.Sprintf("no carbon intensity of %s in %d, using the one of %d", report.Region, year, carbonIntensity.Year))
+				}
+			}
 			report.Tags[tag].CO2e += localEnergy * (1e-3 * carbonIntensity.Value)
+			if !record.Timestamp.Before(latestRun) {
+				latestRun = record.Timestamp
+				report.CarbonIntensityYear = carbonIntensity.Year
+			}
 		}
 	}
+	report.Warnings = append(report.Warnings, providerWarnings(tdpProvider)...)
 
-	jsonData, _ := json.MarshalIndent(report, "", "     ")
-	fmt.Printf("%s\n", jsonData)
+	return report, nil
+}
 
+// WriteReport renders the report in JSON format
+func WriteReport(w io.Writer, report *Report) error {
+	jsonData, err := json.MarshalIndent(report, "", "     ")
+	if err != nil {
+		return fmt.Errorf("encode report: %w", err)
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", jsonData); err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
 	return nil
 }
+
+// MakeReport builds the report on the consumption in the log file
+// and writes it to w. If logFilename is empty, all the logs
+// in the calcium directory are used.
+func MakeReport(w io.Writer, logFilename string, options ReportOptions) (*Report, error) {
+	records, err := readLogs(logFilename)
+	if err != nil {
+		return nil, fmt.Errorf("read log file: %w", err)
+	}
+
+	if options.TDPProvider == nil {
+		options.TDPProvider = DefaultTDPProvider(options.Offline)
+	}
+	if options.CarbonIntensityData == nil && options.Region != "" {
+		options.CarbonIntensityData, err = DefaultCarbonIntensityData()
+		if err != nil {
+			return nil, fmt.Errorf("get carbon intensity data: %w", err)
+		}
+	}
+
+	report, err := BuildReport(records, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := WriteReport(w, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,313 @@
+package calcium
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unkaktus/calcium/data"
+)
+
+// stubTDPProvider knows the TDP per core of the CPUs in the map
+type stubTDPProvider map[string]float64
+
+func (s stubTDPProvider) Lookup(ctx context.Context, cpuString string) (*TDPInfo, error) {
+	watts, ok := s[cpuString]
+	if !ok {
+		return nil, ErrTDPNotFound
+	}
+	return &TDPInfo{
+		CPUString: cpuString,
+		Watts:     watts,
+		Source:    "stub",
+	}, nil
+}
+
+func testRecord(cpu, tag string, cpuTime time.Duration, timestamp time.Time) LogRecord {
+	return LogRecord{
+		Timestamp:   timestamp,
+		CPU:         cpu,
+		Tag:         tag,
+		UserCPUTime: cpuTime,
+		StartTime:   timestamp.Add(-cpuTime),
+		WallTime:    cpuTime,
+	}
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
+
+func TestBuildReportEstimatedEnergy(t *testing.T) {
+	timestamp := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	records := []LogRecord{
+		testRecord("Test CPU", "a", 2*time.Hour, timestamp),
+		testRecord("Test CPU", "a", time.Hour, timestamp),
+		testRecord("Test CPU", "b", time.Hour, timestamp),
+	}
+	report, err := BuildReport(records, ReportOptions{
+		NodeFactor:  1.5,
+		TDPProvider: stubTDPProvider{"Test CPU": 10},
+	})
+	if err != nil {
+		t.Fatalf("BuildReport: %v", err)
+	}
+
+	a := report.Tags["a"]
+	if a.Runs != 2 || !almostEqual(a.CPUTime, 3) {
+		t.Errorf("tag a: got %d runs and %v h, want 2 runs and 3 h", a.Runs, a.CPUTime)
+	}
+	if want := 3 * 10e-3 * 1.5; !almostEqual(a.Energy, want) {
+		t.Errorf("tag a: got energy %v kWh, want %v kWh", a.Energy, want)
+	}
+	if want := 10e-3 * 1.5; !almostEqual(report.Tags["b"].Energy, want) {
+		t.Errorf("tag b: got energy %v kWh, want %v kWh", report.Tags["b"].Energy, want)
+	}
+	if tdpInfo := report.CPUs["Test CPU"]; tdpInfo == nil || tdpInfo.Source != "stub" {
+		t.Errorf("got CPU TDP info %+v, want the one of the provider", tdpInfo)
+	}
+}
+
+func TestBuildReportMeasuredEnergy(t *testing.T) {
+	record := testRecord("Unknown CPU", "a", time.Hour, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	record.EnergyMeasured = true
+	record.Energy = 7.2e6 // [J]
+
+	report, err := BuildReport([]LogRecord{record}, ReportOptions{
+		TDPProvider: stubTDPProvider{},
+	})
+	if err != nil {
+		t.Fatalf("BuildReport: %v", err)
+	}
+	a := report.Tags["a"]
+	// Measured energy is not scaled by the node factor
+	if a.MeasuredRuns != 1 || !almostEqual(a.Energy, 2) {
+		t.Errorf("got %d measured runs and %v kWh, want 1 measured run and 2 kWh", a.MeasuredRuns, a.Energy)
+	}
+	if len(report.CPUs) != 0 {
+		t.Errorf("got TDP info for measured runs: %v", report.CPUs)
+	}
+}
+
+func TestBuildReportUnknownTDP(t *testing.T) {
+	records := []LogRecord{
+		testRecord("Unknown CPU", "a", time.Hour, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)),
+		testRecord("Unknown CPU", "a", time.Hour, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)),
+	}
+
+	if _, err := BuildReport(records, ReportOptions{TDPProvider: stubTDPProvider{}}); err == nil {
+		t.Errorf("got no error for unknown TDP when online")
+	}
+
+	report, err := BuildReport(records, ReportOptions{
+		NodeFactor:   1,
+		Offline:      true,
+		DefaultWatts: 5,
+		TDPProvider:  stubTDPProvider{},
+	})
+	if err != nil {
+		t.Fatalf("BuildReport: %v", err)
+	}
+	if want := 2 * 5e-3; !almostEqual(report.Tags["a"].Energy, want) {
+		t.Errorf("got energy %v kWh, want %v kWh", report.Tags["a"].Energy, want)
+	}
+	if len(report.Warnings) != 1 || !strings.Contains(report.Warnings[0], "Unknown CPU") {
+		t.Errorf("got warnings %q, want a single one on the unknown CPU", report.Warnings)
+	}
+	if report.CPUs["Unknown CPU"].Source != SourceDefault {
+		t.Errorf("got source %q, want %q", report.CPUs["Unknown CPU"].Source, SourceDefault)
+	}
+}
+
+func TestBuildReportFilters(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []LogRecord{
+		testRecord("Test CPU", "a", time.Hour, since.Add(-time.Second)),
+		testRecord("Test CPU", "a", time.Hour, since),
+		testRecord("Test CPU", "a", time.Hour, until),
+		testRecord("Test CPU", "b", time.Hour, since),
+	}
+	report, err := BuildReport(records, ReportOptions{
+		Tags:        []string{"a"},
+		Since:       since,
+		Until:       until,
+		TDPProvider: stubTDPProvider{"Test CPU": 10},
+	})
+	if err != nil {
+		t.Fatalf("BuildReport: %v", err)
+	}
+	if len(report.Tags) != 1 || report.Tags["a"].Runs != 1 {
+		t.Errorf("got tags %v, want a single run of a", report.Tags)
+	}
+}
+
+func TestBuildReportCarbonIntensity(t *testing.T) {
+	dataset, err := data.ReadCarbonIntensityDataset(strings.NewReader(
+		"region,year,value\nTST,2020,100\nTST,2023,200\n",
+	))
+	if err != nil {
+		t.Fatalf("read dataset: %v", err)
+	}
+	records := []LogRecord{
+		testRecord("Test CPU", "a", time.Hour, time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)),
+		testRecord("Test CPU", "a", time.Hour, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)),
+	}
+	report, err := BuildReport(records, ReportOptions{
+		Region:              "tst",
+		NodeFactor:          1,
+		TDPProvider:         stubTDPProvider{"Test CPU": 1000},
+		CarbonIntensityData: dataset,
+	})
+	if err != nil {
+		t.Fatalf("BuildReport: %v", err)
+	}
+	if report.Region != "TST" {
+		t.Errorf("got region %q, want TST", report.Region)
+	}
+	// 1 kWh per run, at 100 and 200 gCO2e/kWh, the latter of the nearest year
+	if want := 0.3; !almostEqual(report.Tags["a"].CO2e, want) {
+		t.Errorf("got %v kg CO2e, want %v kg", report.Tags["a"].CO2e, want)
+	}
+	if year := report.CarbonIntensities[2024].Year; year != 2023 {
+		t.Errorf("got carbon intensity of %d for 2024, want 2023", year)
+	}
+	if report.CarbonIntensityYear != 2023 {
+		t.Errorf("got carbon intensity year %d, want 2023 of the latest run", report.CarbonIntensityYear)
+	}
+
+	if _, err := BuildReport(records, ReportOptions{
+		Region:              "XYZ",
+		TDPProvider:         stubTDPProvider{"Test CPU": 1000},
+		CarbonIntensityData: dataset,
+	}); err == nil {
+		t.Errorf("got no error for unknown region")
+	}
+}
+
+func TestBuildReportSubregion(t *testing.T) {
+	records := []LogRecord{
+		testRecord("Test CPU", "a", time.Hour, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)),
+	}
+	tests := []struct {
+		region   string
+		warnings []string
+	}{
+		{"Guinea-Bissau", nil},
+		{"USA-XXXX", []string{`unknown subregion "USA-XXXX", using the carbon intensity of USA`}},
+		{"CA-QC", []string{"no carbon intensity of CAN-QC in 2024, using the one of 2022"}},
+	}
+	for _, test := range tests {
+		report, err := BuildReport(records, ReportOptions{
+			Region:      test.region,
+			TDPProvider: stubTDPProvider{"Test CPU": 1000},
+		})
+		if err != nil {
+			t.Fatalf("BuildReport(%q): %v", test.region, err)
+		}
+		if !slices.Equal(report.Warnings, test.warnings) {
+			t.Errorf("BuildReport(%q): got warnings %q, want %q", test.region, report.Warnings, test.warnings)
+		}
+	}
+}
+
+func TestBuildReportSMTScaling(t *testing.T) {
+	timestamp := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	smtRecord := testRecord("Test CPU", "smt", time.Hour, timestamp)
+	smtRecord.ThreadsPerCore = 2
+	// Older logs have no threads per core
+	oldRecord := testRecord("Test CPU", "old", time.Hour, timestamp)
+
+	tests := []struct {
+		smtFactor float64
+		smtEnergy float64 // [kWh]
+	}{
+		{smtFactor: 0, smtEnergy: 10e-3},
+		{smtFactor: 1, smtEnergy: 10e-3},
+		{smtFactor: SMTFactorPerThread, smtEnergy: 5e-3},
+		{smtFactor: 0.7, smtEnergy: 7e-3},
+	}
+	for _, test := range tests {
+		report, err := BuildReport([]LogRecord{smtRecord, oldRecord}, ReportOptions{
+			NodeFactor:  1,
+			SMTFactor:   test.smtFactor,
+			TDPProvider: stubTDPProvider{"Test CPU": 10},
+		})
+		if err != nil {
+			t.Fatalf("BuildReport: %v", err)
+		}
+		if energy := report.Tags["smt"].Energy; !almostEqual(energy, test.smtEnergy) {
+			t.Errorf("SMT factor %v: got energy %v kWh, want %v kWh", test.smtFactor, energy, test.smtEnergy)
+		}
+		if energy := report.Tags["old"].Energy; !almostEqual(energy, 10e-3) {
+			t.Errorf("SMT factor %v: got energy %v kWh for older log, want unscaled %v kWh", test.smtFactor, energy, 10e-3)
+		}
+	}
+}
+
+func TestBuildReportHost(t *testing.T) {
+	overrides := &TDPOverrides{Overrides: []TDPOverride{
+		{Glob: "Test*", Watts: 10},
+		{Regex: "^Test", Host: "gpu*", Watts: 20},
+	}}
+	if err := overrides.compile(); err != nil {
+		t.Fatalf("compile overrides: %v", err)
+	}
+	provider := TDPProviderFunc(func(ctx context.Context, cpuString string) (*TDPInfo, error) {
+		tdpInfo, ok, err := overrides.TDPInfo(cpuString, hostFromContext(ctx))
+		if err == nil && !ok {
+			err = ErrTDPNotFound
+		}
+		return tdpInfo, err
+	})
+
+	timestamp := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	gpuRecord := testRecord("Test CPU", "gpu", time.Hour, timestamp)
+	gpuRecord.Host = "gpu01.cluster"
+	cpuRecord := testRecord("Test CPU", "cpu", time.Hour, timestamp)
+	cpuRecord.Host = "cpu01.cluster"
+	// Older logs have no host
+	oldRecord := testRecord("Test CPU", "old", time.Hour, timestamp)
+
+	report, err := BuildReport([]LogRecord{gpuRecord, cpuRecord, oldRecord}, ReportOptions{
+		NodeFactor:  1,
+		TDPProvider: provider,
+	})
+	if err != nil {
+		t.Fatalf("BuildReport: %v", err)
+	}
+	for tag, want := range map[string]float64{"gpu": 20e-3, "cpu": 10e-3, "old": 10e-3} {
+		if energy := report.Tags[tag].Energy; !almostEqual(energy, want) {
+			t.Errorf("tag %s: got energy %v kWh, want %v kWh", tag, energy, want)
+		}
+	}
+}
+
+func TestBuildReportMatchedCPU(t *testing.T) {
+	provider := TDPProviderFunc(func(ctx context.Context, cpuString string) (*TDPInfo, error) {
+		return &TDPInfo{
+			CPUString:        cpuString,
+			Watts:            10,
+			Source:           SourceBundled,
+			MatchedCPUString: "Intel(R) Xeon(R) Platinum 8468",
+			MatchConfidence:  0.95,
+		}, nil
+	})
+	timestamp := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	records := []LogRecord{
+		testRecord("Intel Zeon Platinum 8468", "a", time.Hour, timestamp),
+		testRecord("Intel Zeon Platinum 8468", "a", time.Hour, timestamp),
+	}
+	report, err := BuildReport(records, ReportOptions{TDPProvider: provider})
+	if err != nil {
+		t.Fatalf("BuildReport: %v", err)
+	}
+	if len(report.Warnings) != 1 ||
+		!strings.Contains(report.Warnings[0], "Intel(R) Xeon(R) Platinum 8468") ||
+		!strings.Contains(report.Warnings[0], "0.95") {
+		t.Errorf("got warnings %q, want a single one on the matched CPU and its confidence", report.Warnings)
+	}
+}
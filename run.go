@@ -1,22 +1,48 @@
 package calcium
 
 import (
+	"encoding/csv"
 	"fmt"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path"
-	"path/filepath"
-	"strings"
 	"syscall"
 	"time"
-
-	cpuid "github.com/klauspost/cpuid/v2"
 )
 
 const killTimeout = 5 * time.Second
 
-func RunTransparentCommand(cmdline []string) error {
+// ExitCode returns the exit status of a finished process,
+// following the shell convention of 128+signal for processes
+// terminated by a signal.
+func ExitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+// RunResult describes a single run of a command.
+type RunResult struct {
+	StartTime      time.Time
+	EndTime        time.Time
+	ExitCode       int
+	EnergyMeasured bool
+	Energy         float64 // [J]
+}
+
+// WallTime returns the elapsed real time of the run.
+func (r *RunResult) WallTime() time.Duration {
+	return r.EndTime.Sub(r.StartTime)
+}
+
+// RunTransparentCommand runs the command and returns the result of the run.
+// The error is only returned if the command could not be run at all,
+// the result is returned in any case.
+// If RAPL counters are available under powercapRoot, the package energy
+// consumed during the run is measured. Empty powercapRoot disables the measurement.
+func RunTransparentCommand(cmdline []string, powercapRoot string) (*RunResult, error) {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
@@ -25,8 +51,22 @@ func RunTransparentCommand(cmdline []string) error {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
+	var raplMeter *RAPLMeter
+	if powercapRoot != "" {
+		// Energy is not measured if the counters are unavailable or unreadable
+		raplMeter, _ = StartRAPLMeter(powercapRoot)
+	}
+
+	result := &RunResult{
+		StartTime: time.Now(),
+		ExitCode:  -1,
+	}
 	if err := cmd.Start(); err != nil {
-		return err
+		result.EndTime = time.Now()
+		if raplMeter != nil {
+			raplMeter.Stop()
+		}
+		return result, err
 	}
 
 	done := make(chan bool, 1)
@@ -44,10 +84,23 @@ func RunTransparentCommand(cmdline []string) error {
 		cmd.Process.Kill()
 	}(cmd)
 
-	if err := cmd.Wait(); err != nil {
-		return err
+	err := cmd.Wait()
+	result.EndTime = time.Now()
+
+	if raplMeter != nil {
+		if energy, err := raplMeter.Stop(); err == nil {
+			result.Energy = energy
+			result.EnergyMeasured = true
+		}
 	}
-	return nil
+
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return result, err
+		}
+	}
+	result.ExitCode = ExitCode(cmd.ProcessState)
+	return result, nil
 }
 
 func getCalciumDir() (string, error) {
@@ -63,40 +116,78 @@ func getCalciumDir() (string, error) {
 	return calciumDir, nil
 }
 
-func WriteLog(tag string) error {
-	calciumDir, err := getCalciumDir()
+// WriteLog appends the run to the log in the calcium directory
+// using the given log format.
+func WriteLog(tag string, result *RunResult, format LogFormat) error {
+	logFilename, err := defaultLogFilename(format)
 	if err != nil {
-		return fmt.Errorf("get calcium directory: %w", err)
+		return err
+	}
+	// The log is opened under the lock, as repairs replace the file
+	unlock, err := lockFile(logFilename)
+	if err != nil {
+		return fmt.Errorf("lock log file: %w", err)
 	}
+	defer unlock()
+
+	writeHeader := format == LogFormatCSV && needsCSVLogHeader(logFilename)
 
-	logFilename := filepath.Join(calciumDir, "log.csv")
 	logFile, err := os.OpenFile(logFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0775)
 	if err != nil {
 		return fmt.Errorf("open log file: %w", err)
 	}
 	defer logFile.Close()
 
-	if err := syscall.Flock(int(logFile.Fd()), syscall.LOCK_EX); err != nil {
-		return fmt.Errorf("acquire log file lock: %w", err)
-	}
-	defer syscall.Flock(int(logFile.Fd()), syscall.LOCK_UN)
-
-	cpuTime, err := GetCPUTime()
+	resourceUsage, err := GetResourceUsage()
 	if err != nil {
 		return err
 	}
 
-	log := strings.Join([]string{
-		time.Now().Format(time.DateTime),
-		"\"" + cpuid.CPU.BrandName + "\"",
-		tag,
-		fmt.Sprintf("%.2f", cpuTime.User.Seconds()),
-		fmt.Sprintf("%.2f", cpuTime.System.Seconds()),
-	}, ",")
+	// The hostname is only used to match host-specific TDP overrides
+	hostname, _ := os.Hostname()
+	cpuString := CPUString()
+	record := LogRecord{
+		Timestamp:                  result.EndTime,
+		CPU:                        cpuString,
+		Tag:                        tag,
+		UserCPUTime:                resourceUsage.User,
+		SystemCPUTime:              resourceUsage.System,
+		ExitCode:                   result.ExitCode,
+		StartTime:                  result.StartTime,
+		WallTime:                   result.WallTime(),
+		MaxRSS:                     resourceUsage.MaxRSS,
+		InBlock:                    resourceUsage.InBlock,
+		OutBlock:                   resourceUsage.OutBlock,
+		VoluntaryContextSwitches:   resourceUsage.VoluntaryContextSwitches,
+		InvoluntaryContextSwitches: resourceUsage.InvoluntaryContextSwitches,
+		EnergyMeasured:             result.EnergyMeasured,
+		Energy:                     result.Energy,
+		ThreadsPerCore:             ThreadsPerCore(),
+		CPUModel:                   NormalizeCPUString(cpuString),
+		Host:                       hostname,
+	}
 
-	_, err = fmt.Fprintf(logFile, "%s\n", log)
-	if err != nil {
-		return fmt.Errorf("write log to file: %w", err)
+	switch format {
+	case LogFormatJSONL:
+		log, err := formatJSONLogRecord(record)
+		if err != nil {
+			return fmt.Errorf("format log record: %w", err)
+		}
+		if _, err := fmt.Fprintf(logFile, "%s\n", log); err != nil {
+			return fmt.Errorf("write log to file: %w", err)
+		}
+	default:
+		if writeHeader {
+			if err := writeCSVLogHeader(logFile); err != nil {
+				return fmt.Errorf("write log header to file: %w", err)
+			}
+		}
+		csvWriter := csv.NewWriter(logFile)
+		csvWriter.Write(logRecordRow(record))
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return fmt.Errorf("write log to file: %w", err)
+		}
 	}
 	return nil
 }
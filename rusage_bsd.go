@@ -0,0 +1,6 @@
+//go:build dragonfly || freebsd || netbsd || openbsd
+
+package calcium
+
+// BSDs report maxrss in kilobytes
+const maxRSSUnit = 1024
@@ -0,0 +1,4 @@
+package calcium
+
+// macOS reports maxrss in bytes
+const maxRSSUnit = 1
@@ -0,0 +1,4 @@
+package calcium
+
+// Linux reports maxrss in kilobytes
+const maxRSSUnit = 1024
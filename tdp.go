@@ -1,24 +1,38 @@
 package calcium
 
 import (
-	"encoding/csv"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	partialparser "github.com/blaze2305/partial-json-parser"
 	"github.com/blaze2305/partial-json-parser/options"
+	"github.com/unkaktus/calcium/data"
 	"golang.org/x/net/html"
 )
 
+// ARM server CPUs and Apple chips have no spec pages to look up the TDP
+var noSpecPageVendorPrefixes = []string{"ARM ", "AWS ", "Ampere", "NVIDIA", "Fujitsu", "HiSilicon", "Qualcomm", "Apple"}
+
+func hasNoSpecPages(cpuString string) bool {
+	for _, prefix := range noSpecPageVendorPrefixes {
+		if strings.HasPrefix(cpuString, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func getVendorDomain(cpuString string) string {
+	cpuString = generationPrefixPattern.ReplaceAllString(cpuString, "")
 	if strings.HasPrefix(cpuString, "Intel") {
 		return "www.intel.com"
 	}
@@ -30,8 +44,11 @@ func getVendorDomain(cpuString string) string {
 
 func buildQuery(cpuString string) (string, error) {
 	vendorDomain := getVendorDomain(cpuString)
+	if vendorDomain == "" && hasNoSpecPages(cpuString) {
+		return "", fmt.Errorf("no spec page lookup for this vendor, set a TDP override: %w", ErrTDPNotFound)
+	}
 	if vendorDomain == "" {
-		return "", fmt.Errorf("unknown vendor")
+		return "", fmt.Errorf("unknown vendor: %w", ErrTDPNotFound)
 	}
 	query := "! " + cpuString + " site:" + vendorDomain
 	if vendorDomain == "www.amd.com" {
@@ -40,26 +57,23 @@ func buildQuery(cpuString string) (string, error) {
 	return query, nil
 }
 
-func GetSpecPageURL(cpuString string) (string, error) {
+// GetSpecPageURL finds the vendor spec page of the CPU using DuckDuckGo bangs.
+// DefaultHTTPClient is used if client is nil.
+func GetSpecPageURL(ctx context.Context, client *HTTPClient, cpuString string) (string, error) {
+	if client == nil {
+		client = DefaultHTTPClient
+	}
 	query, err := buildQuery(cpuString)
 	if err != nil {
 		return "", fmt.Errorf("build query: %w", err)
 	}
 	q := url.QueryEscape(query)
 	u := "https://api.duckduckgo.com/?q=" + q + "&format=json"
-	req, err := http.NewRequest(http.MethodGet, u, http.NoBody)
-	if err != nil {
-		return "", fmt.Errorf("create request: %w", err)
-	}
-	resp, err := http.DefaultTransport.RoundTrip(req)
+	location, err := client.GetRedirect(ctx, u)
 	if err != nil {
 		return "", fmt.Errorf("get: %w", err)
 	}
-	location, err := resp.Location()
-	if err != nil {
-		return "", fmt.Errorf("get location: %w", err)
-	}
-	return location.String(), nil
+	return location, nil
 }
 
 type AMDSpecs struct {
@@ -67,12 +81,59 @@ type AMDSpecs struct {
 		DefaultTDP struct {
 			FormatValue string `json:"formatValue"`
 		} `json:"defaultTdp"`
+		ConfigurableTDP struct {
+			FormatValue string `json:"formatValue"`
+		} `json:"amdConfigurableTdp"`
 		NumOfCpuCores struct {
 			FormatValue string `json:"formatValue"`
 		} `json:"numOfCpuCores"`
+		NumOfThreads struct {
+			FormatValue string `json:"formatValue"`
+		} `json:"numOfThreads"`
+		BaseClock struct {
+			FormatValue string `json:"formatValue"`
+		} `json:"baseClock"`
 	} `json:"elements"`
 }
 
+// parseClockGHz parses the clock frequency like "2.10 GHz" or "800 MHz" in GHz
+func parseClockGHz(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	scale := 1.0
+	switch {
+	case strings.HasSuffix(s, "GHz"):
+		s = strings.TrimSuffix(s, "GHz")
+	case strings.HasSuffix(s, "MHz"):
+		s = strings.TrimSuffix(s, "MHz")
+		scale = 1e-3
+	default:
+		return 0, fmt.Errorf("unknown clock unit")
+	}
+	clock, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, err
+	}
+	return clock * scale, nil
+}
+
+// parseWattsRange parses the power like "28 W", or the range like "15-30W"
+func parseWattsRange(s string) (low, high float64, err error) {
+	s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "W"))
+	lowString, highString, isRange := strings.Cut(s, "-")
+	low, err = strconv.ParseFloat(strings.TrimSpace(lowString), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return low, low, nil
+	}
+	high, err = strconv.ParseFloat(strings.TrimSpace(highString), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return low, high, nil
+}
+
 func tokenHasAttributeValue(token html.Token, key, value string) bool {
 	for _, attr := range token.Attr {
 		if attr.Key == key {
@@ -113,18 +174,52 @@ func skipTokens(z *html.Tokenizer, n int) error {
 	return nil
 }
 
-func ExtractTDP(specURL string) (float64, error) {
-	req, _ := http.NewRequest(http.MethodGet, specURL, http.NoBody)
-	resp, err := http.DefaultTransport.RoundTrip(req)
+// TDP settings of mobile CPUs with configurable TDP
+const (
+	TDPSettingNominal = "nominal"
+	TDPSettingUp      = "cTDP-up"
+	TDPSettingDown    = "cTDP-down"
+)
+
+// CPUSpecs are the CPU specifications found on the vendor page
+type CPUSpecs struct {
+	PackageWatts     float64
+	Cores            int
+	Threads          int     // Zero if unknown
+	BaseClockGHz     float64 // Zero if unknown
+	PerformanceCores int     // Zero if not a hybrid CPU
+	EfficiencyCores  int     // Zero if not a hybrid CPU
+	TDPDownWatts     float64 // Zero if no configurable TDP
+	TDPUpWatts       float64 // Zero if no configurable TDP
+	TDPSetting       string  // The setting of PackageWatts if the TDP is configurable
+}
+
+// ExtractSpecs fetches the vendor spec page and extracts the CPU specifications.
+// DefaultHTTPClient is used if client is nil.
+func ExtractSpecs(ctx context.Context, client *HTTPClient, specURL string) (*CPUSpecs, error) {
+	if client == nil {
+		client = DefaultHTTPClient
+	}
+	page, err := client.Get(ctx, specURL)
 	if err != nil {
-		return 0, fmt.Errorf("fetch page: %w", err)
+		return nil, fmt.Errorf("fetch page: %w", err)
 	}
-	defer resp.Body.Close()
+	return ParseSpecPage(bytes.NewReader(page))
+}
 
-	z := html.NewTokenizer(resp.Body)
+// ParseSpecPage extracts the CPU specifications from an Intel ARK page
+// or an AMD product page with the data-product-specs attribute.
+func ParseSpecPage(r io.Reader) (*CPUSpecs, error) {
+	z := html.NewTokenizer(r)
 
 	TotalTDP := 0.0
 	CoreCount := 0.0
+	ThreadCount := 0.0
+	BaseClock := 0.0
+	PerformanceCoreCount := 0.0
+	EfficiencyCoreCount := 0.0
+	TDPDown := 0.0
+	TDPUp := 0.0
 
 	for {
 		tt := z.Next()
@@ -132,35 +227,39 @@ func ExtractTDP(specURL string) (float64, error) {
 			if z.Err() == io.EOF {
 				break
 			}
-			return 0, z.Err()
+			return nil, z.Err()
 		}
 		token := z.Token()
 
 		if token.Data == "div" {
 			if tokenHasAttributeValue(token, "class", "tech-section-row") {
 				if err := iterateUntilAttribute(z, "class", "tech-label"); err != nil {
-					return 0, err
+					return nil, err
 				}
 				if err := skipTokens(z, 3); err != nil {
-					return 0, err
+					return nil, err
 				}
 				raw := z.Raw()
 				field := strings.TrimSpace(string(raw))
-				if !slices.Contains([]string{"TDP", "Total Cores"}, field) {
+				if !slices.Contains([]string{
+					"TDP", "Processor Base Power", "Configurable TDP-up", "Configurable TDP-down",
+					"Total Cores", "Total Threads", "# of Performance-cores", "# of Efficient-cores",
+					"Processor Base Frequency",
+				}, field) {
 					continue
 				}
 
 				if err := iterateUntilAttribute(z, "class", "tech-data"); err != nil {
-					return 0, err
+					return nil, err
 				}
 				if err := skipTokens(z, 3); err != nil {
-					return 0, err
+					return nil, err
 				}
 				raw = z.Raw()
 				s := strings.TrimSpace(string(raw))
 
 				switch field {
-				case "TDP":
+				case "TDP", "Processor Base Power", "Configurable TDP-up", "Configurable TDP-down":
 					if !strings.HasSuffix(s, " W") {
 						continue
 					}
@@ -169,13 +268,44 @@ func ExtractTDP(specURL string) (float64, error) {
 					if err != nil {
 						break
 					}
-					TotalTDP = tdp
+					switch field {
+					case "Configurable TDP-up":
+						TDPUp = tdp
+					case "Configurable TDP-down":
+						TDPDown = tdp
+					default:
+						TotalTDP = tdp
+					}
 				case "Total Cores":
 					coreCount, err := strconv.ParseFloat(s, 32)
 					if err != nil {
 						break
 					}
 					CoreCount = coreCount
+				case "Total Threads":
+					threadCount, err := strconv.ParseFloat(s, 32)
+					if err != nil {
+						break
+					}
+					ThreadCount = threadCount
+				case "# of Performance-cores":
+					performanceCoreCount, err := strconv.ParseFloat(s, 32)
+					if err != nil {
+						break
+					}
+					PerformanceCoreCount = performanceCoreCount
+				case "# of Efficient-cores":
+					efficiencyCoreCount, err := strconv.ParseFloat(s, 32)
+					if err != nil {
+						break
+					}
+					EfficiencyCoreCount = efficiencyCoreCount
+				case "Processor Base Frequency":
+					baseClock, err := parseClockGHz(s)
+					if err != nil {
+						break
+					}
+					BaseClock = baseClock
 				}
 			}
 		}
@@ -187,143 +317,205 @@ func ExtractTDP(specURL string) (float64, error) {
 
 					value, err := partialparser.ParseMalformedString(d, options.NUM|options.ARR|options.OBJ, false)
 					if err != nil {
-						return 0, fmt.Errorf("decode AMD specs: %w", err)
+						return nil, fmt.Errorf("decode AMD specs: %w", err)
 					}
 
 					specs := &AMDSpecs{}
 					err = json.Unmarshal([]byte(value), specs)
 					if err != nil {
-						return 0, fmt.Errorf("decode AMD specs: %w", err)
+						return nil, fmt.Errorf("decode AMD specs: %w", err)
 					}
-					s := strings.TrimRight(specs.Elements.DefaultTDP.FormatValue, "W")
-					tdp, err := strconv.ParseFloat(s, 32)
+					coreCount, err := strconv.ParseFloat(specs.Elements.NumOfCpuCores.FormatValue, 32)
 					if err != nil {
 						break
 					}
-					coreCount, err := strconv.ParseFloat(specs.Elements.NumOfCpuCores.FormatValue, 32)
-					if err != nil {
+					// The default TDP is the nominal one, and the configurable
+					// TDP range is listed separately. Some pages list
+					// the range as the default TDP instead.
+					defaultDown, defaultUp, err := parseWattsRange(specs.Elements.DefaultTDP.FormatValue)
+					if err == nil {
+						if defaultDown == defaultUp {
+							TotalTDP = defaultUp
+						} else {
+							TDPDown = defaultDown
+							TDPUp = defaultUp
+						}
+					}
+					tdpDown, tdpUp, err := parseWattsRange(specs.Elements.ConfigurableTDP.FormatValue)
+					if err == nil && tdpDown != tdpUp {
+						TDPDown = tdpDown
+						TDPUp = tdpUp
+					}
+					if TotalTDP == 0 && TDPUp == 0 {
 						break
 					}
-					TotalTDP = tdp
 					CoreCount = coreCount
+
+					// Thread count and base clock are optional
+					threadCount, err := strconv.ParseFloat(specs.Elements.NumOfThreads.FormatValue, 32)
+					if err == nil {
+						ThreadCount = threadCount
+					}
+					baseClock, err := parseClockGHz(specs.Elements.BaseClock.FormatValue)
+					if err == nil {
+						BaseClock = baseClock
+					}
 				}
 			}
 		}
 	}
 
+	// Use the nominal TDP of mobile CPUs, or the upper one
+	// if only the configurable range is known
+	tdpSetting := ""
+	if TDPDown != 0 || TDPUp != 0 {
+		tdpSetting = TDPSettingNominal
+		if TotalTDP == 0 {
+			TotalTDP = TDPUp
+			tdpSetting = TDPSettingUp
+		}
+	}
+
 	if TotalTDP == 0 || CoreCount == 0 {
-		return 0, fmt.Errorf("TDP not found")
+		return nil, ErrTDPNotFound
 	}
 
-	tdp := TotalTDP / CoreCount
-	return tdp, nil
+	specs := &CPUSpecs{
+		PackageWatts:     TotalTDP,
+		Cores:            int(CoreCount),
+		Threads:          int(ThreadCount),
+		BaseClockGHz:     BaseClock,
+		PerformanceCores: int(PerformanceCoreCount),
+		EfficiencyCores:  int(EfficiencyCoreCount),
+		TDPDownWatts:     TDPDown,
+		TDPUpWatts:       TDPUp,
+		TDPSetting:       tdpSetting,
+	}
+	return specs, nil
+}
+
+// WattsPerCore returns the TDP per core
+func (s *CPUSpecs) WattsPerCore() float64 {
+	return s.PackageWatts / float64(s.Cores)
+}
+
+// ExtractTDP fetches the vendor spec page and extracts the TDP per core
+func ExtractTDP(ctx context.Context, client *HTTPClient, specURL string) (float64, error) {
+	specs, err := ExtractSpecs(ctx, client, specURL)
+	if err != nil {
+		return 0, err
+	}
+	return specs.WattsPerCore(), nil
 }
 
 type TDPInfo struct {
-	CPUString string
-	Watts     float64
-	Source    string
+	CPUString        string
+	Model            string  `json:",omitempty"` // Canonical model identifier
+	Watts            float64 // Per core
+	Source           string
+	PackageWatts     float64    `json:",omitempty"`
+	Cores            int        `json:",omitempty"`
+	Threads          int        `json:",omitempty"`
+	BaseClockGHz     float64    `json:",omitempty"`
+	PerformanceCores int        `json:",omitempty"`
+	EfficiencyCores  int        `json:",omitempty"`
+	TDPDownWatts     float64    `json:",omitempty"`
+	TDPUpWatts       float64    `json:",omitempty"`
+	TDPSetting       string     `json:",omitempty"` // Configurable TDP setting used for Watts
+	FetchedAt        *time.Time `json:",omitempty"`
+	// Set if the TDP info is of the closest known CPU
+	MatchedCPUString string  `json:",omitempty"`
+	MatchConfidence  float64 `json:",omitempty"`
 }
 
-func GetTDPInfo(cpuString string) (*TDPInfo, error) {
-	specURL, err := GetSpecPageURL(cpuString)
+// GetTDPInfo looks up the TDP info on the vendor spec page.
+// DefaultHTTPClient is used if client is nil.
+func GetTDPInfo(ctx context.Context, client *HTTPClient, cpuString string) (*TDPInfo, error) {
+	specURL, err := GetSpecPageURL(ctx, client, cpuString)
 	if err != nil {
 		return nil, fmt.Errorf("get spec page: %w", err)
 	}
 
-	tdp, err := ExtractTDP(specURL)
+	specs, err := ExtractSpecs(ctx, client, specURL)
 	if err != nil {
 		return nil, fmt.Errorf("get TDP: %w", err)
 	}
 
+	fetchedAt := time.Now()
 	ti := &TDPInfo{
-		CPUString: cpuString,
-		Watts:     tdp,
-		Source:    specURL,
+		CPUString:        cpuString,
+		Watts:            specs.WattsPerCore(),
+		Source:           specURL,
+		PackageWatts:     specs.PackageWatts,
+		Cores:            specs.Cores,
+		Threads:          specs.Threads,
+		BaseClockGHz:     specs.BaseClockGHz,
+		PerformanceCores: specs.PerformanceCores,
+		EfficiencyCores:  specs.EfficiencyCores,
+		TDPDownWatts:     specs.TDPDownWatts,
+		TDPUpWatts:       specs.TDPUpWatts,
+		TDPSetting:       specs.TDPSetting,
+		FetchedAt:        &fetchedAt,
 	}
 	return ti, nil
 }
 
-func readTDPCache() (map[string]TDPInfo, error) {
-	calciumDir, err := getCalciumDir()
-	if err != nil {
-		return nil, fmt.Errorf("get calcium directory: %w", err)
+// SourceBundled marks TDP info from the database bundled with calcium
+const SourceBundled = "bundled"
+
+// GetTDPInfoBundled returns the TDP info from the bundled database
+// of the same CPU model
+func GetTDPInfoBundled(cpuString string) (*TDPInfo, bool) {
+	tdp, ok := data.TDPs[cpuString]
+	if !ok {
+		for bundledCPUString, bundledTDP := range data.TDPs {
+			if SameCPUModel(bundledCPUString, cpuString) {
+				tdp, ok = bundledTDP, true
+				break
+			}
+		}
 	}
-	cacheFilename := filepath.Join(calciumDir, "tdp-cache.csv")
-	cacheFile, err := os.OpenFile(cacheFilename, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0775)
-	if err != nil {
-		return nil, fmt.Errorf("open report file: %w", err)
+	if !ok {
+		return nil, false
 	}
-	defer cacheFile.Close()
-
-	csvReader := csv.NewReader(cacheFile)
-	records, err := csvReader.ReadAll()
-	if err != nil {
-		return nil, fmt.Errorf("read cache file: %w", err)
+	tdpInfo := &TDPInfo{
+		CPUString:        cpuString,
+		Watts:            tdp.Watts,
+		Source:           SourceBundled,
+		PackageWatts:     tdp.PackageWatts,
+		Cores:            tdp.Cores,
+		Threads:          tdp.Threads,
+		BaseClockGHz:     tdp.BaseClockGHz,
+		PerformanceCores: tdp.PerformanceCores,
+		EfficiencyCores:  tdp.EfficiencyCores,
+		TDPDownWatts:     tdp.TDPDownWatts,
+		TDPUpWatts:       tdp.TDPUpWatts,
 	}
-	cache := map[string]TDPInfo{}
-	for _, row := range records {
-		if len(row) != 3 {
-			return nil, fmt.Errorf("invalid TDP record length")
-		}
-		tdp, err := strconv.ParseFloat(row[1], 32)
-		if err != nil {
-			return nil, fmt.Errorf("parse TDP value: %w", err)
-		}
-		cpuString := row[0]
-		source := row[2]
-		cache[cpuString] = TDPInfo{
-			CPUString: cpuString,
-			Watts:     tdp,
-			Source:    source,
-		}
+	if tdp.TDPDownWatts != 0 || tdp.TDPUpWatts != 0 {
+		tdpInfo.TDPSetting = TDPSettingNominal
 	}
-	return cache, nil
+	return tdpInfo, true
 }
 
-func writeTDPCache(cpuString string, tdpInfo TDPInfo) error {
-	calciumDir, err := getCalciumDir()
-	if err != nil {
-		return fmt.Errorf("get calcium directory: %w", err)
-	}
-	cacheFilename := filepath.Join(calciumDir, "tdp-cache.csv")
-	cacheFile, err := os.OpenFile(cacheFilename, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0775)
-	if err != nil {
-		return fmt.Errorf("open report file: %w", err)
-	}
-	defer cacheFile.Close()
-
-	entry := strings.Join([]string{
-		"\"" + cpuString + "\"",
-		fmt.Sprintf("%.4f", tdpInfo.Watts),
-		tdpInfo.Source,
-	}, ",")
-
-	_, err = fmt.Fprintf(cacheFile, "%s\n", entry)
-	if err != nil {
-		return fmt.Errorf("write report to file: %w", err)
-	}
-	return nil
+// GetTDPInfoOffline returns the TDP info from the user overrides,
+// the bundled database or the local cache without any network access.
+func GetTDPInfoOffline(cpuString string) (*TDPInfo, error) {
+	return lookupTDPInfo(DefaultTDPProvider(true), cpuString)
 }
 
+// GetTDPInfoCached returns the TDP info from the user overrides, the bundled database,
+// the local cache, or looks it up on the web and caches it.
 func GetTDPInfoCached(cpuString string) (*TDPInfo, error) {
-	cache, err := readTDPCache()
-	if err != nil {
-		return nil, fmt.Errorf("read cache: %w", err)
-	}
-
-	if tdpInfo, ok := cache[cpuString]; ok {
-		return &tdpInfo, nil
-	}
+	return lookupTDPInfo(DefaultTDPProvider(false), cpuString)
+}
 
-	tdpInfo, err := GetTDPInfo(cpuString)
+func lookupTDPInfo(provider TDPProvider, cpuString string) (*TDPInfo, error) {
+	// The CPU is looked up for this host
+	hostname, _ := os.Hostname()
+	tdpInfo, err := provider.Lookup(WithHost(context.Background(), hostname), cpuString)
 	if err != nil {
 		return nil, err
 	}
-
-	if err := writeTDPCache(cpuString, *tdpInfo); err != nil {
-		return nil, fmt.Errorf("write TDP cache: %w", err)
-	}
-
+	tdpInfo.Model = NormalizeCPUString(cpuString)
 	return tdpInfo, nil
 }
@@ -0,0 +1,165 @@
+package calcium
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSpecPage(t *testing.T) {
+	tests := []struct {
+		page  string
+		specs *CPUSpecs // nil if parsing fails
+	}{
+		{
+			page: "ark-xeon-gold-6148.html",
+			specs: &CPUSpecs{
+				PackageWatts: 150,
+				Cores:        20,
+				Threads:      40,
+				BaseClockGHz: 2.4,
+			},
+		},
+		{
+			// Only the configurable TDP range is listed
+			page: "ark-core-i7-1165g7.html",
+			specs: &CPUSpecs{
+				PackageWatts: 28,
+				Cores:        4,
+				Threads:      8,
+				TDPDownWatts: 12,
+				TDPUpWatts:   28,
+				TDPSetting:   TDPSettingUp,
+			},
+		},
+		{
+			page: "ark-core-i7-1265u.html",
+			specs: &CPUSpecs{
+				PackageWatts:     15,
+				Cores:            10,
+				Threads:          12,
+				PerformanceCores: 2,
+				EfficiencyCores:  8,
+			},
+		},
+		{page: "ark-missing-cores.html"},
+		{page: "ark-malformed-tdp.html"},
+		{
+			page: "amd-epyc-7763.html",
+			specs: &CPUSpecs{
+				PackageWatts: 280,
+				Cores:        64,
+				Threads:      128,
+				BaseClockGHz: 2.45,
+				TDPDownWatts: 225,
+				TDPUpWatts:   280,
+				TDPSetting:   TDPSettingNominal,
+			},
+		},
+		{
+			// The specs attribute is cut off
+			page: "amd-ryzen-7-7840u.html",
+			specs: &CPUSpecs{
+				PackageWatts: 28,
+				Cores:        8,
+				Threads:      16,
+				BaseClockGHz: 3.3,
+				TDPDownWatts: 15,
+				TDPUpWatts:   30,
+				TDPSetting:   TDPSettingNominal,
+			},
+		},
+		{page: "amd-missing-tdp.html"},
+		{page: "amd-malformed-specs.html"},
+	}
+	for _, test := range tests {
+		t.Run(strings.TrimSuffix(test.page, ".html"), func(t *testing.T) {
+			page, err := os.Open(filepath.Join("testdata", test.page))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer page.Close()
+
+			specs, err := ParseSpecPage(page)
+			if test.specs == nil {
+				if err == nil {
+					t.Errorf("got specs %+v, want error", specs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSpecPage: %v", err)
+			}
+			if !reflect.DeepEqual(specs, test.specs) {
+				t.Errorf("got specs %+v, want %+v", specs, test.specs)
+			}
+		})
+	}
+}
+
+func TestParseSpecPageEmpty(t *testing.T) {
+	for _, page := range []string{"", "not a page", "<html><body><div class=\"tech-section-row\"></div></body></html>"} {
+		if specs, err := ParseSpecPage(strings.NewReader(page)); err == nil {
+			t.Errorf("page %q: got specs %+v, want error", page, specs)
+		}
+	}
+}
+
+func TestGetVendorDomain(t *testing.T) {
+	tests := map[string]string{
+		"Intel(R) Xeon(R) Gold 6148 CPU @ 2.40GHz":       "www.intel.com",
+		"11th Gen Intel(R) Core(TM) i7-1165G7 @ 2.80GHz": "www.intel.com",
+		"AMD EPYC 7763 64-Core Processor":                "www.amd.com",
+		"AWS Graviton3":                                  "",
+	}
+	for cpuString, want := range tests {
+		if got := getVendorDomain(cpuString); got != want {
+			t.Errorf("getVendorDomain(%q) = %q, want %q", cpuString, got, want)
+		}
+	}
+}
+
+func TestGetTDPInfoBundled(t *testing.T) {
+	for _, cpuString := range []string{
+		"11th Gen Intel(R) Core(TM) i7-1165G7 @ 2.80GHz",
+		"Intel Core i7-1165G7",
+	} {
+		tdpInfo, ok := GetTDPInfoBundled(cpuString)
+		if !ok {
+			t.Errorf("%q not found", cpuString)
+			continue
+		}
+		if tdpInfo.Cores != 4 || tdpInfo.TDPSetting != TDPSettingNominal {
+			t.Errorf("%q: got TDP info %+v, want 4 cores and nominal TDP", cpuString, tdpInfo)
+		}
+	}
+}
+
+func TestSpecPageMatchesBundled(t *testing.T) {
+	tests := map[string]string{
+		"amd-epyc-7763.html":      "AMD EPYC 7763 64-Core Processor",
+		"amd-ryzen-7-7840u.html":  "AMD Ryzen 7 7840U w/ Radeon 780M Graphics",
+		"ark-xeon-gold-6148.html": "Intel(R) Xeon(R) Gold 6148 CPU @ 2.40GHz",
+	}
+	for page, cpuString := range tests {
+		pageFile, err := os.Open(filepath.Join("testdata", page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		specs, err := ParseSpecPage(pageFile)
+		pageFile.Close()
+		if err != nil {
+			t.Fatalf("%s: ParseSpecPage: %v", page, err)
+		}
+		tdpInfo, ok := GetTDPInfoBundled(cpuString)
+		if !ok {
+			t.Fatalf("%q not bundled", cpuString)
+		}
+		if !almostEqual(specs.WattsPerCore(), tdpInfo.Watts) || specs.TDPSetting != tdpInfo.TDPSetting {
+			t.Errorf("%s: got %.4f W per core (%q) from the page, and %.4f W (%q) bundled", page,
+				specs.WattsPerCore(), specs.TDPSetting, tdpInfo.Watts, tdpInfo.TDPSetting)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package calcium
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// TDPCache is the local cache of the TDP info looked up on the web.
+// Its rows are CPU string, TDP per core, source, fetch time,
+// package TDP, core count, thread count, base clock,
+// performance and efficiency core counts, configurable TDP down and up,
+// and the TDP setting. Older caches have only the first three, six or eight.
+type TDPCache struct {
+	Entries []TDPInfo
+	// Malformed rows that were skipped while reading
+	Malformed []error
+}
+
+// Get returns the cached TDP info of the CPU model
+func (c *TDPCache) Get(cpuString string) (*TDPInfo, bool) {
+	for i := range c.Entries {
+		if SameCPUModel(c.Entries[i].CPUString, cpuString) {
+			return &c.Entries[i], true
+		}
+	}
+	return nil, false
+}
+
+// Set adds the TDP info, replacing the one of the same CPU model
+func (c *TDPCache) Set(tdpInfo TDPInfo) {
+	for i := range c.Entries {
+		if SameCPUModel(c.Entries[i].CPUString, tdpInfo.CPUString) {
+			c.Entries[i] = tdpInfo
+			return
+		}
+	}
+	c.Entries = append(c.Entries, tdpInfo)
+}
+
+// Remove removes the TDP info of the CPU model
+func (c *TDPCache) Remove(cpuString string) bool {
+	for i := range c.Entries {
+		if SameCPUModel(c.Entries[i].CPUString, cpuString) {
+			c.Entries = append(c.Entries[:i], c.Entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func tdpCacheFilename() (string, error) {
+	calciumDir, err := getCalciumDir()
+	if err != nil {
+		return "", fmt.Errorf("get calcium directory: %w", err)
+	}
+	return filepath.Join(calciumDir, "tdp-cache.csv"), nil
+}
+
+func tdpCacheRow(tdpInfo TDPInfo) []string {
+	row := []string{
+		tdpInfo.CPUString,
+		fmt.Sprintf("%.4f", tdpInfo.Watts),
+		tdpInfo.Source,
+		"",
+		"",
+		"",
+		"",
+		"",
+		"",
+		"",
+		"",
+		"",
+		tdpInfo.TDPSetting,
+	}
+	if tdpInfo.FetchedAt != nil {
+		row[3] = tdpInfo.FetchedAt.Format(time.RFC3339)
+	}
+	if tdpInfo.PackageWatts != 0 {
+		row[4] = strconv.FormatFloat(tdpInfo.PackageWatts, 'f', -1, 64)
+	}
+	if tdpInfo.Cores != 0 {
+		row[5] = strconv.Itoa(tdpInfo.Cores)
+	}
+	if tdpInfo.Threads != 0 {
+		row[6] = strconv.Itoa(tdpInfo.Threads)
+	}
+	if tdpInfo.BaseClockGHz != 0 {
+		row[7] = strconv.FormatFloat(tdpInfo.BaseClockGHz, 'f', -1, 64)
+	}
+	if tdpInfo.PerformanceCores != 0 {
+		row[8] = strconv.Itoa(tdpInfo.PerformanceCores)
+	}
+	if tdpInfo.EfficiencyCores != 0 {
+		row[9] = strconv.Itoa(tdpInfo.EfficiencyCores)
+	}
+	if tdpInfo.TDPDownWatts != 0 {
+		row[10] = strconv.FormatFloat(tdpInfo.TDPDownWatts, 'f', -1, 64)
+	}
+	if tdpInfo.TDPUpWatts != 0 {
+		row[11] = strconv.FormatFloat(tdpInfo.TDPUpWatts, 'f', -1, 64)
+	}
+	return row
+}
+
+func parseTDPCacheRow(row []string) (*TDPInfo, error) {
+	if len(row) < 3 {
+		return nil, fmt.Errorf("invalid TDP record length")
+	}
+	watts, err := strconv.ParseFloat(row[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse TDP value: %w", err)
+	}
+	tdpInfo := &TDPInfo{
+		CPUString: row[0],
+		Watts:     watts,
+		Source:    row[2],
+	}
+	if len(row) > 3 && row[3] != "" {
+		fetchedAt, err := time.Parse(time.RFC3339, row[3])
+		if err != nil {
+			return nil, fmt.Errorf("parse fetch time: %w", err)
+		}
+		tdpInfo.FetchedAt = &fetchedAt
+	}
+	if len(row) > 4 && row[4] != "" {
+		tdpInfo.PackageWatts, err = strconv.ParseFloat(row[4], 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse package TDP: %w", err)
+		}
+	}
+	if len(row) > 5 && row[5] != "" {
+		tdpInfo.Cores, err = strconv.Atoi(row[5])
+		if err != nil {
+			return nil, fmt.Errorf("parse core count: %w", err)
+		}
+	}
+	if len(row) > 6 && row[6] != "" {
+		tdpInfo.Threads, err = strconv.Atoi(row[6])
+		if err != nil {
+			return nil, fmt.Errorf("parse thread count: %w", err)
+		}
+	}
+	if len(row) > 7 && row[7] != "" {
+		tdpInfo.BaseClockGHz, err = strconv.ParseFloat(row[7], 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse base clock: %w", err)
+		}
+	}
+	if len(row) > 8 && row[8] != "" {
+		tdpInfo.PerformanceCores, err = strconv.Atoi(row[8])
+		if err != nil {
+			return nil, fmt.Errorf("parse performance core count: %w", err)
+		}
+	}
+	if len(row) > 9 && row[9] != "" {
+		tdpInfo.EfficiencyCores, err = strconv.Atoi(row[9])
+		if err != nil {
+			return nil, fmt.Errorf("parse efficiency core count: %w", err)
+		}
+	}
+	if len(row) > 10 && row[10] != "" {
+		tdpInfo.TDPDownWatts, err = strconv.ParseFloat(row[10], 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse configurable TDP down: %w", err)
+		}
+	}
+	if len(row) > 11 && row[11] != "" {
+		tdpInfo.TDPUpWatts, err = strconv.ParseFloat(row[11], 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse configurable TDP up: %w", err)
+		}
+	}
+	if len(row) > 12 {
+		tdpInfo.TDPSetting = row[12]
+	}
+	return tdpInfo, nil
+}
+
+// ReadTDPCacheFrom reads the TDP cache. Malformed rows are skipped,
+// and later rows replace the earlier ones of the same CPU.
+func ReadTDPCacheFrom(r io.Reader) (*TDPCache, error) {
+	csvReader := csv.NewReader(r)
+	csvReader.FieldsPerRecord = -1
+
+	cache := &TDPCache{}
+	for {
+		row, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		parseError := &csv.ParseError{}
+		if errors.As(err, &parseError) {
+			cache.Malformed = append(cache.Malformed, err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read cache: %w", err)
+		}
+		tdpInfo, err := parseTDPCacheRow(row)
+		if err != nil {
+			line, _ := csvReader.FieldPos(0)
+			cache.Malformed = append(cache.Malformed, fmt.Errorf("line %d: %w", line, err))
+			continue
+		}
+		cache.Set(*tdpInfo)
+	}
+	return cache, nil
+}
+
+// WriteTDPCacheTo writes the TDP cache
+func WriteTDPCacheTo(w io.Writer, cache *TDPCache) error {
+	csvWriter := csv.NewWriter(w)
+	for _, tdpInfo := range cache.Entries {
+		csvWriter.Write(tdpCacheRow(tdpInfo))
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// ReadTDPCache reads the TDP cache in the calcium directory
+func ReadTDPCache() (*TDPCache, error) {
+	cacheFilename, err := tdpCacheFilename()
+	if err != nil {
+		return nil, err
+	}
+	return readTDPCacheFile(cacheFilename)
+}
+
+func readTDPCacheFile(cacheFilename string) (*TDPCache, error) {
+	cacheFile, err := os.Open(cacheFilename)
+	if errors.Is(err, os.ErrNotExist) {
+		return &TDPCache{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open cache file: %w", err)
+	}
+	defer cacheFile.Close()
+
+	return ReadTDPCacheFrom(cacheFile)
+}
+
+// WriteTDPCache replaces the TDP cache in the calcium directory
+func WriteTDPCache(cache *TDPCache) error {
+	cacheFilename, err := tdpCacheFilename()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockFile(cacheFilename)
+	if err != nil {
+		return fmt.Errorf("lock cache file: %w", err)
+	}
+	defer unlock()
+
+	return writeTDPCacheFile(cacheFilename, cache)
+}
+
+// UpdateTDPCache reads the TDP cache in the calcium directory, changes it with update,
+// and writes it back, holding the lock all along so that concurrent appends are not lost.
+// The cache is not written if update fails.
+func UpdateTDPCache(update func(*TDPCache) error) error {
+	cacheFilename, err := tdpCacheFilename()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockFile(cacheFilename)
+	if err != nil {
+		return fmt.Errorf("lock cache file: %w", err)
+	}
+	defer unlock()
+
+	cache, err := readTDPCacheFile(cacheFilename)
+	if err != nil {
+		return fmt.Errorf("read cache: %w", err)
+	}
+	if err := update(cache); err != nil {
+		return err
+	}
+	return writeTDPCacheFile(cacheFilename, cache)
+}
+
+// writeTDPCacheFile replaces the cache file, the cache lock must be held
+func writeTDPCacheFile(cacheFilename string, cache *TDPCache) error {
+	cacheFile, err := os.CreateTemp(filepath.Dir(cacheFilename), filepath.Base(cacheFilename))
+	if err != nil {
+		return fmt.Errorf("create cache file: %w", err)
+	}
+	defer os.Remove(cacheFile.Name())
+	defer cacheFile.Close()
+	if err := cacheFile.Chmod(0775); err != nil {
+		return fmt.Errorf("set cache file mode: %w", err)
+	}
+
+	if err := WriteTDPCacheTo(cacheFile, cache); err != nil {
+		return fmt.Errorf("write cache to file: %w", err)
+	}
+	if err := cacheFile.Close(); err != nil {
+		return fmt.Errorf("close cache file: %w", err)
+	}
+	if err := os.Rename(cacheFile.Name(), cacheFilename); err != nil {
+		return fmt.Errorf("replace cache file: %w", err)
+	}
+	return nil
+}
+
+// AppendTDPCache adds the TDP info to the end of the TDP cache in the calcium directory
+func AppendTDPCache(tdpInfo TDPInfo) error {
+	cacheFilename, err := tdpCacheFilename()
+	if err != nil {
+		return err
+	}
+	// The cache is opened under the lock, as rewrites replace the file
+	unlock, err := lockFile(cacheFilename)
+	if err != nil {
+		return fmt.Errorf("lock cache file: %w", err)
+	}
+	defer unlock()
+
+	cacheFile, err := os.OpenFile(cacheFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0775)
+	if err != nil {
+		return fmt.Errorf("open cache file: %w", err)
+	}
+	defer cacheFile.Close()
+
+	if err := WriteTDPCacheTo(cacheFile, &TDPCache{Entries: []TDPInfo{tdpInfo}}); err != nil {
+		return fmt.Errorf("write cache to file: %w", err)
+	}
+	return nil
+}
+
+// RefreshTDPCache looks up again the cached CPUs fetched earlier than olderThan ago,
+// or all of them if olderThan is zero. Only the given CPUs are refreshed, if any.
+// The entries that failed to refresh are kept, and the errors are returned.
+// The lookups are done before locking the cache, and the refreshed entries
+// are merged into the cache as it is then.
+func RefreshTDPCache(cpuStrings []string, olderThan time.Duration) ([]error, error) {
+	cache, err := ReadTDPCache()
+	if err != nil {
+		return nil, fmt.Errorf("read cache: %w", err)
+	}
+
+	refreshErrors := []error{}
+	for _, cpuString := range cpuStrings {
+		if _, ok := cache.Get(cpuString); !ok {
+			refreshErrors = append(refreshErrors, fmt.Errorf("%s: not in cache", cpuString))
+		}
+	}
+
+	refreshed := []TDPInfo{}
+	for _, tdpInfo := range cache.Entries {
+		if len(cpuStrings) > 0 && !slices.ContainsFunc(cpuStrings, func(cpuString string) bool {
+			return SameCPUModel(cpuString, tdpInfo.CPUString)
+		}) {
+			continue
+		}
+		if olderThan != 0 && tdpInfo.FetchedAt != nil && time.Since(*tdpInfo.FetchedAt) < olderThan {
+			continue
+		}
+		refreshedInfo, err := GetTDPInfo(context.Background(), nil, tdpInfo.CPUString)
+		if err != nil {
+			refreshErrors = append(refreshErrors, fmt.Errorf("%s: %w", tdpInfo.CPUString, err))
+			continue
+		}
+		refreshed = append(refreshed, *refreshedInfo)
+	}
+
+	if err := UpdateTDPCache(func(cache *TDPCache) error {
+		for _, tdpInfo := range refreshed {
+			cache.Set(tdpInfo)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("update cache: %w", err)
+	}
+	return refreshErrors, nil
+}